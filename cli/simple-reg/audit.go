@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	auditservice "github.com/nilspolek/simple-reg/internal/server/audit-service"
+)
+
+func runAudit(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: simple-reg audit verify [flags] <file>")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	head := flags.String("head", "", "hash of a record noted earlier that has to be part of the chain, detects truncation and rewrites")
+	flags.Parse(args[1:])
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: simple-reg audit verify [flags] <file>")
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	defer file.Close()
+
+	found := false
+	last, err := auditservice.Verify(file, func(record auditservice.Record) {
+		found = found || record.Hash == *head
+	})
+	if err != nil {
+		fatal(err)
+	}
+	if *head != "" && !found {
+		fatal(fmt.Errorf("%w: no record has hash %s", auditservice.ErrChainBroken, *head))
+	}
+
+	fmt.Printf("ok: %d records, head %s\n", last.Seq, last.Hash)
+}
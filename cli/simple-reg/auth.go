@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	authservice "github.com/nilspolek/simple-reg/internal/server/auth-service"
+)
+
+// setupAuth installs the authentication and authorization middlewares the
+// flags ask for. Authentication has to be installed before authorization.
+func setupAuth(svr *server.Server) error {
+	if tlsClientCA != "" {
+		if err := authservice.ValidateCertificateField(tlsClientIdentity); err != nil {
+			return err
+		}
+	}
+
+	var htpasswd *authservice.Htpasswd
+	if htpasswdPath != "" {
+		var err error
+		if htpasswd, err = authservice.LoadHtpasswd(htpasswdPath); err != nil {
+			return err
+		}
+	}
+
+	var policy *authservice.Policy
+	if policyPath != "" {
+		var err error
+		if policy, err = authservice.LoadPolicy(policyPath); err != nil {
+			return err
+		}
+	}
+
+	robots, err := authservice.LoadRobotStore(robotsPath)
+	if err != nil {
+		return err
+	}
+	robots.WithLogger(*svr.GetLogger())
+	svr.WithShutdownHook(func(context.Context) error {
+		robots.Close()
+		return nil
+	})
+
+	authenticator := authservice.Authenticators{robots}
+	if htpasswd != nil {
+		authenticator = append(authenticator, htpasswd)
+	}
+
+	anonymousPull := authservice.NewAnonymousPull(anonymous...)
+
+	var authentication func(http.Handler) http.Handler
+	switch authMode {
+	case "basic":
+		// robots authenticate without users, but a policy alone would
+		// lock everybody out
+		if htpasswd == nil && len(robots.List()) == 0 && policy != nil {
+			return errors.New("-policy needs -htpasswd or robots to authenticate callers")
+		}
+		if htpasswd != nil || len(robots.List()) > 0 {
+			authentication = authservice.BasicAuth(realm, authenticator)
+		}
+	case "token":
+		tokens, err := newTokenService(authenticator)
+		if err != nil {
+			return err
+		}
+
+		authorizer := authservice.Authorizer(authservice.AuthenticatedOnly)
+		if policy != nil {
+			authorizer = policy.Authorizer
+		}
+		tokens.WithAuthorizer(anonymousPull.Authorizer(robots.Authorizer(authorizer)))
+
+		svr.WithHandlerFunc(authservice.TOKEN_PATH, tokens.HandleToken, http.MethodGet)
+		authentication = tokens.Middleware
+	default:
+		return fmt.Errorf("unknown authentication mode %q", authMode)
+	}
+
+	if tlsClientCA != "" {
+		authentication = authservice.ClientCertificate(tlsClientIdentity, authentication)
+	}
+	if authentication == nil {
+		// without users nobody could authenticate, keep the registry open
+		// but not the admin routes
+		svr.WithMiddleware(authservice.DenyAdmin)
+		return nil
+	}
+	svr.WithMiddleware(anonymousPull.Authentication(authentication))
+
+	// only a policy can grant the admin permission
+	authorization := authservice.DenyAdmin
+	if policy != nil {
+		authorization = policy.Middleware
+	}
+	svr.WithMiddleware(anonymousPull.Authorization(robots.Authorization(authorization)))
+
+	svr.WithHandlerFunc("/admin/robots", robots.HandleList, http.MethodGet)
+	svr.WithHandlerFunc("/admin/robots", robots.HandleCreate, http.MethodPost)
+	svr.WithHandlerFunc("/admin/robots/{robot}", robots.HandleRevoke, http.MethodDelete)
+	return nil
+}
+
+func newTokenService(authenticator authservice.Authenticator) (*authservice.TokenService, error) {
+	var key crypto.Signer
+	var err error
+	if tokenKey != "" {
+		key, err = authservice.LoadSigningKey(tokenKey)
+	} else {
+		key, err = authservice.GenerateSigningKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := authservice.NewTokenService(tokenIssuer, tokenService, key, authenticator)
+	if err != nil {
+		return nil, err
+	}
+	return tokens.WithRealm(tokenRealm).WithExpiry(tokenExpiry), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+	authservice "github.com/nilspolek/simple-reg/internal/server/auth-service"
+)
+
+// useBasicAuth sets the authentication flags to basic mode without an
+// htpasswd file for the duration of t.
+func useBasicAuth(t *testing.T, policy, robots string) {
+	t.Helper()
+	mode, htpasswd, policyFile, robotsFile := authMode, htpasswdPath, policyPath, robotsPath
+	authMode, htpasswdPath, policyPath, robotsPath = "basic", "", policy, robots
+	t.Cleanup(func() {
+		authMode, htpasswdPath, policyPath, robotsPath = mode, htpasswd, policyFile, robotsFile
+	})
+}
+
+func TestBasicAuthWithoutHtpasswd(t *testing.T) {
+	dir := t.TempDir()
+	policy := writeConfig(t, "rules:\n  - subjects: [\"*\"]\n    repositories: [\"**\"]\n    permissions: [pull]\n")
+
+	// without users and robots the registry stays open
+	useBasicAuth(t, "", filepath.Join(dir, "none.json"))
+	svr, err := newAuthServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(svr, "/v2/app/tags/list", "", ""); status != http.StatusOK {
+		t.Errorf("open registry answered %d", status)
+	}
+
+	// nobody could authenticate against the policy
+	useBasicAuth(t, policy, filepath.Join(dir, "none.json"))
+	if _, err := newAuthServer(); err == nil || !strings.Contains(err.Error(), "-policy") {
+		t.Errorf("policy without users and robots returned %v", err)
+	}
+
+	// robots authenticate without users
+	robotsFile := filepath.Join(dir, "robots.json")
+	token := storeRobot(t, robotsFile)
+	for _, policy := range []string{"", policy} {
+		useBasicAuth(t, policy, robotsFile)
+		svr, err := newAuthServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := get(svr, "/v2/app/tags/list", "", ""); status != http.StatusUnauthorized {
+			t.Errorf("anonymous request with policy %q answered %d, want %d", policy, status, http.StatusUnauthorized)
+		}
+		if status := get(svr, "/v2/app/tags/list", "robot$ci", token); status != http.StatusOK {
+			t.Errorf("robot with policy %q answered %d", policy, status)
+		}
+		if status := get(svr, "/admin/robots", "robot$ci", token); status != http.StatusForbidden {
+			t.Errorf("robot listing robots with policy %q answered %d, want %d", policy, status, http.StatusForbidden)
+		}
+	}
+}
+
+// storeRobot stores the robot ci pulling app in path and returns its token.
+func storeRobot(t *testing.T, path string) string {
+	t.Helper()
+	robots, err := authservice.LoadRobotStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := robots.Create(authservice.Robot{Name: "ci", Repositories: []string{"app"}, Actions: []string{authservice.ACTION_PULL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record a use now, so the stores loaded from path have no use to save
+	// while the temporary directory is removed
+	robots.Authenticate("robot$ci", token)
+	robots.Close()
+	return token
+}
+
+// newAuthServer sets up rate limits and authentication as the flags ask for
+// on a server whose tag listings answer 200.
+func newAuthServer() (*server.Server, error) {
+	svr := server.NewServer().WithRouter(mux.NewRouter())
+	svr.WithHandlerFunc("/v2/{name}/tags/list", func(w http.ResponseWriter, r *http.Request) {}, http.MethodGet)
+	return svr, setupAccess(svr)
+}
+
+func TestRateLimitsRefundAcrossAuthentication(t *testing.T) {
+	useBasicAuth(t, "", filepath.Join(t.TempDir(), "robots.json"))
+	token := storeRobot(t, robotsPath)
+	limits := rateLimits
+	rateLimits = []server.RateLimit{
+		{Scope: server.RATE_LIMIT_IP, Action: server.RATE_LIMIT_PULL, Requests: 2, Per: time.Hour, Burst: 2},
+		{Scope: server.RATE_LIMIT_USER, Action: server.RATE_LIMIT_PULL, Requests: 1, Per: time.Hour, Burst: 1},
+	}
+	t.Cleanup(func() { rateLimits = limits })
+
+	svr, err := newAuthServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{"robot$ci", http.StatusOK},
+		// rejected by the user limit after authentication, the client IP
+		// token taken before it is given back
+		{"robot$ci", http.StatusTooManyRequests},
+		// failed logins count
+		{"", http.StatusUnauthorized},
+		{"", http.StatusTooManyRequests},
+	}
+	for i, test := range tests {
+		password := ""
+		if test.user != "" {
+			password = token
+		}
+		if status := get(svr, "/v2/app/tags/list", test.user, password); status != test.status {
+			t.Fatalf("request %d as %q answered %d, want %d", i, test.user, status, test.status)
+		}
+	}
+}
+
+// get requests path from svr, with basic credentials unless user is empty,
+// and returns the status.
+func get(svr *server.Server, path, user, password string) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	w := httptest.NewRecorder()
+	svr.Router.ServeHTTP(w, r)
+	return w.Code
+}
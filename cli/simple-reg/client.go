@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// credentials are sent as basic authentication with every admin request.
+var credentials string
+
+// call sends body as JSON to the admin API and decodes the JSON response into
+// v. A bearer challenge is answered by fetching a token from the announced
+// realm.
+func call(method, url string, body, v any) error {
+	payload := []byte{}
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := send(method, url, payload, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if challenge, ok := strings.CutPrefix(resp.Header.Get("WWW-Authenticate"), "Bearer "); ok && resp.StatusCode == http.StatusUnauthorized {
+		token, err := fetchToken(challenge)
+		if err != nil {
+			return err
+		}
+
+		resp.Body.Close()
+		if resp, err = send(method, url, payload, token); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func send(method, url string, body []byte, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user, password, ok := strings.Cut(credentials, ":"); ok {
+		req.SetBasicAuth(user, password)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// parseAuthParams parses the comma separated auth-params of a challenge,
+// e.g. `realm="https://host/token",scope="repository:a:pull,push"`. Quoted
+// values may contain commas and backslash escapes, names are case
+// insensitive.
+func parseAuthParams(challenge string) map[string]string {
+	params := map[string]string{}
+	rest := challenge
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		name, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			return params
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(after, " \t")
+
+		value := ""
+		quoted := strings.HasPrefix(rest, `"`)
+		if quoted {
+			var unescaped strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				unescaped.WriteByte(rest[i])
+			}
+			value = unescaped.String()
+			rest = rest[min(i+1, len(rest)):]
+		}
+
+		// skip to the next parameter, the value when it is a token
+		end := strings.IndexByte(rest, ',')
+		if end < 0 {
+			end = len(rest)
+		}
+		if !quoted {
+			value = strings.TrimSpace(rest[:end])
+		}
+		rest = rest[end:]
+		params[name] = value
+	}
+}
+
+// fetchToken requests a token for the realm, service and scope of a bearer
+// challenge such as `realm="https://host/token",service="svc",scope="..."`.
+func fetchToken(challenge string) (string, error) {
+	params := parseAuthParams(challenge)
+
+	query := url.Values{}
+	query.Set("service", params["service"])
+	query.Set("scope", params["scope"])
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	resp, err := send(http.MethodGet, params["realm"]+"?"+query.Encode(), nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	return token.Token, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
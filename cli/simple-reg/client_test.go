@@ -0,0 +1,47 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		challenge string
+		params    map[string]string
+	}{
+		{
+			`realm="https://host/token",service="registry",scope="repository:a:pull,push"`,
+			map[string]string{"realm": "https://host/token", "service": "registry", "scope": "repository:a:pull,push"},
+		},
+		{
+			`Realm="https://host/token", SCOPE="repository:a:pull"`,
+			map[string]string{"realm": "https://host/token", "scope": "repository:a:pull"},
+		},
+		{
+			`realm = "https://host/token" ,service=registry`,
+			map[string]string{"realm": "https://host/token", "service": "registry"},
+		},
+		{
+			`error="invalid_token",error_description="say \"hi\", \\ then"`,
+			map[string]string{"error": "invalid_token", "error_description": `say "hi", \ then`},
+		},
+		{
+			`scope="",service="registry"`,
+			map[string]string{"scope": "", "service": "registry"},
+		},
+		{
+			`realm="https://host/token`,
+			map[string]string{"realm": "https://host/token"},
+		},
+		{
+			``,
+			map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		if params := parseAuthParams(test.challenge); !maps.Equal(params, test.params) {
+			t.Errorf("parseAuthParams(%q) = %v, want %v", test.challenge, params, test.params)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ENV_PREFIX prefixes the environment variable of every flag, e.g.
+	// SIMPLE_REG_TLS_CERT for -tls-cert.
+	ENV_PREFIX = "SIMPLE_REG_"
+	// ENV_LIST_SEPARATOR separates the values of repeatable flags given as
+	// environment variable.
+	ENV_LIST_SEPARATOR = ";"
+	// STORAGE_FILESYSTEM is the only storage backend so far.
+	STORAGE_FILESYSTEM = "filesystem"
+)
+
+// configKeys maps the settings of the configuration file to the flags they
+// set. Lists set repeatable flags once per item.
+//
+//	listen: ":5000"
+//	storage:
+//	  blob-dir: /var/lib/simple-reg/blobs
+//	auth:
+//	  htpasswd: /etc/simple-reg/htpasswd
+//	  anonymous-pull: [library]
+//	tls:
+//	  cert: /etc/simple-reg/tls.crt
+//	  key: /etc/simple-reg/tls.key
+var configKeys = map[string]string{
+	"listen":                    "listen",
+	"port":                      "port",
+	"shutdown-timeout":          "shutdown-timeout",
+	"timeouts.read-header":      "read-header-timeout",
+	"timeouts.read":             "read-timeout",
+	"timeouts.write":            "write-timeout",
+	"timeouts.idle":             "idle-timeout",
+	"storage.backend":           "storage",
+	"storage.blob-dir":          "blob-dir",
+	"storage.manifest-dir":      "manifest-dir",
+	"storage.min-free-mb":       "min-free-mb",
+	"storage.max-manifest-size": "max-manifest-size",
+	"storage.max-blob-size":     "max-blob-size",
+	"storage.quotas":            "quota",
+	"log.level":                 "log-level",
+	"log.format":                "log-format",
+	"log.access-format":         "access-log-format",
+	"log.access-body-limit":     "access-log-body-limit",
+	"trusted-proxies":           "trusted-proxies",
+	"rate-limits":               "rate-limit",
+	"metrics.listen":            "metrics-listen",
+	"tracing.endpoint":          "otlp-endpoint",
+	"tracing.sample-ratio":      "trace-sample-ratio",
+	"auth.mode":                 "auth-mode",
+	"auth.htpasswd":             "htpasswd",
+	"auth.realm":                "realm",
+	"auth.policy":               "policy",
+	"auth.anonymous-pull":       "anonymous-pull",
+	"auth.robots":               "robots",
+	"auth.token.key":            "token-key",
+	"auth.token.issuer":         "token-issuer",
+	"auth.token.service":        "token-service",
+	"auth.token.realm":          "token-realm",
+	"auth.token.expiry":         "token-expiry",
+	"tls.cert":                  "tls-cert",
+	"tls.key":                   "tls-key",
+	"tls.min-version":           "tls-min-version",
+	"tls.cipher-suites":         "tls-cipher-suites",
+	"tls.client-ca":             "tls-client-ca",
+	"tls.client-auth":           "tls-client-auth",
+	"tls.client-identity":       "tls-client-identity",
+	"immutable-tags":            "immutable-tag",
+	"retention.policies":        "retention",
+	"retention.interval":        "retention-interval",
+	"webhooks.config":           "webhooks",
+	"webhooks.queue":            "webhook-queue",
+	"events.log-size":           "event-log-size",
+	"audit.log":                 "audit-log",
+}
+
+// repeatableFlags accept several values, separated by ENV_LIST_SEPARATOR in
+// environment variables.
+var repeatableFlags = map[string]bool{
+	"anonymous-pull": true,
+	"immutable-tag":  true,
+	"retention":      true,
+	"rate-limit":     true,
+	"quota":          true,
+}
+
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig applies the configuration file and the environment to every
+// flag not given on the command line. Environment variables take precedence
+// over the file.
+func loadConfig() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	overridden := func(name string) bool {
+		_, ok := os.LookupEnv(envName(name))
+		return explicit[name] || ok
+	}
+
+	path := configPath
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+	if path != "" {
+		settings, err := readConfig(path)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			name := configKeys[key]
+			if overridden(name) {
+				continue
+			}
+			for _, value := range settings[key] {
+				if err := flag.Set(name, value); err != nil {
+					return fmt.Errorf("%s: %s: %w", path, key, err)
+				}
+			}
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+
+		values := []string{value}
+		if repeatableFlags[f.Name] {
+			values = strings.Split(value, ENV_LIST_SEPARATOR)
+		}
+		for _, value := range values {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// readConfig flattens the YAML file at path to its settings, keyed like
+// configKeys.
+func readConfig(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := map[string][]string{}
+	if len(document.Content) == 0 {
+		return settings, nil
+	}
+	if err := flatten(document.Content[0], "", settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+func flatten(node *yaml.Node, key string, settings map[string][]string) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			if key != "" {
+				name = key + "." + name
+			}
+			if err := flatten(node.Content[i+1], name, settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, ok := configKeys[key]; !ok {
+		return fmt.Errorf("line %d: unknown setting %q", node.Line, key)
+	}
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag != "!!null" {
+			settings[key] = []string{node.Value}
+		}
+	case yaml.SequenceNode:
+		if !repeatableFlags[configKeys[key]] {
+			return fmt.Errorf("line %d: %s takes a single value", node.Line, key)
+		}
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: %s has to be a list of values", item.Line, key)
+			}
+			settings[key] = append(settings[key], item.Value)
+		}
+	default:
+		return fmt.Errorf("line %d: invalid value of %s", node.Line, key)
+	}
+	return nil
+}
+
+// validateConfig checks the settings flags can not check on their own.
+func validateConfig() error {
+	var errs []error
+
+	if listen != "" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			errs = append(errs, fmt.Errorf("listen: %w", err))
+		}
+	} else if port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is out of range", port))
+	}
+
+	if metricsListen != "" {
+		if _, _, err := net.SplitHostPort(metricsListen); err != nil {
+			errs = append(errs, fmt.Errorf("metrics-listen: %w", err))
+		}
+	}
+
+	if otlpEndpoint != "" {
+		if endpoint, err := url.Parse(otlpEndpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs = append(errs, fmt.Errorf("otlp-endpoint: %q is not an http or https URL", otlpEndpoint))
+		}
+	}
+	if traceSampleRatio < 0 || traceSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("trace-sample-ratio: %v is not between 0 and 1", traceSampleRatio))
+	}
+
+	if storage != STORAGE_FILESYSTEM {
+		errs = append(errs, fmt.Errorf("storage: unknown backend %q, expected %s", storage, STORAGE_FILESYSTEM))
+	}
+	if blobDir == "" {
+		errs = append(errs, errors.New("blob-dir: must not be empty"))
+	}
+	if manifestDir == "" {
+		errs = append(errs, errors.New("manifest-dir: must not be empty"))
+	}
+
+	if _, err := zerolog.ParseLevel(logLevel); err != nil || logLevel == "" {
+		errs = append(errs, fmt.Errorf("log-level: unknown level %q", logLevel))
+	}
+	if logFormat != "json" && logFormat != "console" {
+		errs = append(errs, fmt.Errorf("log-format: unknown format %q, expected json or console", logFormat))
+	}
+
+	if accessLogFormat != server.ACCESS_LOG_JSON && accessLogFormat != server.ACCESS_LOG_COMMON {
+		errs = append(errs, fmt.Errorf("access-log-format: unknown format %q, expected json or clf", accessLogFormat))
+	}
+	if accessLogBodies < 0 {
+		errs = append(errs, errors.New("access-log-body-limit: must not be negative"))
+	}
+	if _, err := server.ParseTrustedProxies(strings.Split(trustedProxies, ",")...); err != nil {
+		errs = append(errs, fmt.Errorf("trusted-proxies: %w", err))
+	}
+
+	if authMode != "basic" && authMode != "token" {
+		errs = append(errs, fmt.Errorf("auth-mode: unknown mode %q, expected basic or token", authMode))
+	}
+	if tokenExpiry <= 0 {
+		errs = append(errs, errors.New("token-expiry: must be positive"))
+	}
+	if tlsClientAuth != "optional" && tlsClientAuth != "require" {
+		errs = append(errs, fmt.Errorf("tls-client-auth: unknown client authentication %q, expected optional or require", tlsClientAuth))
+	}
+
+	if retentionTick <= 0 {
+		errs = append(errs, errors.New("retention-interval: must be positive"))
+	}
+	if shutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown-timeout: must not be negative"))
+	}
+	if readHeaderTimeout < 0 || readTimeout < 0 || writeTimeout < 0 || idleTimeout < 0 {
+		errs = append(errs, errors.New("read-header-timeout, read-timeout, write-timeout and idle-timeout: must not be negative"))
+	}
+	if eventLogSize <= 0 {
+		errs = append(errs, errors.New("event-log-size: must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func newLogger() zerolog.Logger {
+	level, _ := zerolog.ParseLevel(logLevel)
+	if isVerbose {
+		level = zerolog.DebugLevel
+	}
+
+	logger := zerolog.New(os.Stdout)
+	if logFormat == "console" {
+		logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout})
+	}
+	return logger.With().Timestamp().Logger().Level(level)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		settings map[string][]string
+		err      string
+	}{
+		{
+			name:     "empty",
+			config:   "",
+			settings: map[string][]string{},
+		},
+		{
+			name: "nested settings",
+			config: `
+listen: ":5000"
+storage:
+  blob-dir: /var/lib/blobs
+auth:
+  token:
+    expiry: 10m
+tls:
+  cert: tls.crt
+`,
+			settings: map[string][]string{
+				"listen":            {":5000"},
+				"storage.blob-dir":  {"/var/lib/blobs"},
+				"auth.token.expiry": {"10m"},
+				"tls.cert":          {"tls.crt"},
+			},
+		},
+		{
+			name: "lists of repeatable settings",
+			config: `
+auth:
+  anonymous-pull: [library, public]
+storage:
+  quotas:
+    - team-a/=50GiB
+`,
+			settings: map[string][]string{
+				"auth.anonymous-pull": {"library", "public"},
+				"storage.quotas":      {"team-a/=50GiB"},
+			},
+		},
+		{
+			name:     "null values are skipped",
+			config:   "log:\n  level:\n",
+			settings: map[string][]string{},
+		},
+		{
+			name:   "unknown setting",
+			config: "storage:\n  bucket: images\n",
+			err:    `line 2: unknown setting "storage.bucket"`,
+		},
+		{
+			name:   "list of a single value setting",
+			config: "listen: [a, b]\n",
+			err:    "listen takes a single value",
+		},
+		{
+			name:   "list of mappings",
+			config: "immutable-tags:\n  - tag: v1\n",
+			err:    "immutable-tags has to be a list of values",
+		},
+		{
+			name:   "mapping for a value",
+			config: "storage: filesystem\n",
+			err:    `unknown setting "storage"`,
+		},
+		{
+			name:   "invalid yaml",
+			config: "listen: [\n",
+			err:    "config.yaml",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := readConfig(writeConfig(t, test.config))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("readConfig returned %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.EqualFunc(settings, test.settings, slices.Equal) {
+				t.Errorf("readConfig = %v, want %v", settings, test.settings)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	commandLine, path := flag.CommandLine, configPath
+	t.Cleanup(func() { flag.CommandLine, configPath = commandLine, path })
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		listen string
+		level  string
+		quotas []string
+	}{
+		{
+			name:   "config file",
+			listen: ":5000",
+			level:  "info",
+			quotas: []string{"a/=1GiB", "b/=2GiB"},
+		},
+		{
+			name:   "environment over config file",
+			env:    map[string]string{"SIMPLE_REG_LOG_LEVEL": "debug", "SIMPLE_REG_QUOTA": "c/=3GiB;d/=4GiB"},
+			listen: ":5000",
+			level:  "debug",
+			quotas: []string{"c/=3GiB", "d/=4GiB"},
+		},
+		{
+			name:   "flags over environment",
+			args:   []string{"-listen", ":6000", "-log-level", "warn"},
+			env:    map[string]string{"SIMPLE_REG_LISTEN": ":7000", "SIMPLE_REG_LOG_LEVEL": "debug"},
+			listen: ":6000",
+			level:  "warn",
+			quotas: []string{"a/=1GiB", "b/=2GiB"},
+		},
+		{
+			name:   "config file from the environment",
+			env:    map[string]string{"SIMPLE_REG_CONFIG": "from-env"},
+			listen: ":5000",
+			level:  "info",
+			quotas: []string{"a/=1GiB", "b/=2GiB"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := writeConfig(t, "listen: \":5000\"\nlog:\n  level: info\nstorage:\n  quotas: [a/=1GiB, b/=2GiB]\n")
+
+			var listen, level string
+			var quotas []string
+			flag.CommandLine = flag.NewFlagSet("simple-reg", flag.ContinueOnError)
+			flag.StringVar(&configPath, "config", "", "")
+			flag.StringVar(&listen, "listen", "", "")
+			flag.StringVar(&level, "log-level", "error", "")
+			flag.Func("quota", "", func(value string) error {
+				quotas = append(quotas, value)
+				return nil
+			})
+
+			for name, value := range test.env {
+				if value == "from-env" {
+					value = config
+				}
+				t.Setenv(name, value)
+			}
+			args := test.args
+			if test.env["SIMPLE_REG_CONFIG"] == "" {
+				args = append([]string{"-config", config}, args...)
+			}
+			if err := flag.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := loadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if listen != test.listen || level != test.level || !slices.Equal(quotas, test.quotas) {
+				t.Errorf("listen %q, log level %q, quotas %v, want %q, %q, %v", listen, level, quotas, test.listen, test.level, test.quotas)
+			}
+		})
+	}
+}
@@ -1,37 +1,360 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/nilspolek/simple-reg/internal/server"
+	auditservice "github.com/nilspolek/simple-reg/internal/server/audit-service"
+	authservice "github.com/nilspolek/simple-reg/internal/server/auth-service"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
 	simpleserver "github.com/nilspolek/simple-reg/internal/server/simple-server"
-	"github.com/rs/zerolog"
 )
 
 var (
-	port      string
-	isVerbose bool
+	configPath        string
+	listen            string
+	port              int
+	storage           string
+	blobDir           string
+	manifestDir       string
+	minFreeMB         uint64
+	quotas            []simpleserver.Quota
+	maxManifestSize   int64
+	maxBlobSize       int64
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	isVerbose         bool
+	logLevel          string
+	logFormat         string
+	metricsListen     string
+	accessLogFormat   string
+	accessLogBodies   int
+	trustedProxies    string
+	rateLimits        []server.RateLimit
+	otlpEndpoint      string
+	traceSampleRatio  float64
+	htpasswdPath      string
+	realm             string
+	authMode          string
+	tokenKey          string
+	tokenIssuer       string
+	tokenService      string
+	tokenRealm        string
+	tokenExpiry       time.Duration
+	policyPath        string
+	anonymous         []string
+	robotsPath        string
+	tlsCert           string
+	tlsKey            string
+	tlsMinVersion     string
+	tlsCiphers        string
+	tlsClientCA       string
+	tlsClientAuth     string
+	tlsClientIdentity string
+	immutableTags     []manifestservice.ImmutableTagRule
+	retention         []manifestservice.RetentionPolicy
+	retentionTick     time.Duration
+	uploadExpiry      time.Duration
+	shutdownTimeout   time.Duration
+	webhooksPath      string
+	webhookQueue      string
+	eventLogSize      int
+	auditLogPath      string
 )
 
 func main() {
-	flag.StringVar(&port, "port", "5000", "port to listen on")
-	flag.BoolVar(&isVerbose, "verbose", false, "verbose logging")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "tag":
+			runTag(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		}
+	}
+
+	flag.StringVar(&configPath, "config", "", "YAML configuration file, flags and "+ENV_PREFIX+"* environment variables take precedence")
+	flag.StringVar(&listen, "listen", "", "address to listen on, e.g. 127.0.0.1:5000 (default: every interface on -port)")
+	flag.IntVar(&port, "port", 5000, "port to listen on")
+	flag.StringVar(&storage, "storage", STORAGE_FILESYSTEM, "storage backend")
+	flag.StringVar(&blobDir, "blob-dir", simpleserver.BlobDir, "directory storing blobs")
+	flag.StringVar(&manifestDir, "manifest-dir", simpleserver.ManifestDir, "directory storing manifests and tags")
+	flag.Uint64Var(&minFreeMB, "min-free-mb", simpleserver.MinFreeBytes>>20, "free disk space in MiB below which /readyz reports the registry unready")
+	flag.Func("quota", "`<repository|namespace/>=<size>` storage quota, e.g. team-a/=50GiB (repeatable)", func(value string) error {
+		quota, err := simpleserver.ParseQuota(value)
+		if err != nil {
+			return err
+		}
+		quotas = append(quotas, quota)
+		return nil
+	})
+	flag.Func("max-manifest-size", "largest manifest accepted, e.g. 8MiB (default 4MiB)", func(value string) (err error) {
+		maxManifestSize, err = server.ParseSize(value)
+		return err
+	})
+	flag.Func("max-blob-size", "largest blob accepted, e.g. 10GiB (default: unlimited)", func(value string) (err error) {
+		maxBlobSize, err = server.ParseSize(value)
+		return err
+	})
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", server.DEFAULT_READ_HEADER_TIMEOUT, "how long clients may take to send the request headers, 0 disables it")
+	flag.DurationVar(&readTimeout, "read-timeout", server.DEFAULT_READ_TIMEOUT, "how long reading a request body may stall before the connection is closed, 0 disables it")
+	flag.DurationVar(&writeTimeout, "write-timeout", server.DEFAULT_WRITE_TIMEOUT, "how long writing a response may stall before the connection is closed, 0 disables it")
+	flag.DurationVar(&idleTimeout, "idle-timeout", server.DEFAULT_IDLE_TIMEOUT, "how long keep-alive connections wait for the next request, 0 disables it")
+	flag.BoolVar(&isVerbose, "verbose", false, "verbose logging, same as -log-level debug")
+	flag.StringVar(&logLevel, "log-level", "error", "minimum log level: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "json", "log format, json or console")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector URL traces are exported to, e.g. http://localhost:4318 (default: disabled unless OTEL_EXPORTER_OTLP_ENDPOINT is set)")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "share of new traces that are recorded, between 0 and 1")
+	flag.StringVar(&accessLogFormat, "access-log-format", server.ACCESS_LOG_JSON, "access log format, json (through the logger, at info level) or clf (Common Log Format on stdout)")
+	flag.IntVar(&accessLogBodies, "access-log-body-limit", 0, "bytes of request and response bodies added to JSON access log entries (default: bodies are not logged)")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated IPs and CIDR ranges of reverse proxies whose X-Forwarded-For is trusted")
+	flag.Func("rate-limit", "`<ip|user|repository>:<pull|push>=<requests>/<duration>[:<burst>]` token bucket rate limit, e.g. ip:pull=100/s:200 (repeatable)", func(value string) error {
+		limit, err := server.ParseRateLimit(value)
+		if err != nil {
+			return err
+		}
+		rateLimits = append(rateLimits, limit)
+		return nil
+	})
+	flag.StringVar(&metricsListen, "metrics-listen", "", "address serving Prometheus metrics on "+server.METRICS_PATH+", e.g. :9090 (default: disabled)")
+	flag.StringVar(&htpasswdPath, "htpasswd", "", "htpasswd file with bcrypt credentials, enables basic authentication")
+	flag.StringVar(&realm, "realm", "simple-reg", "realm of the basic authentication challenge")
+	flag.StringVar(&authMode, "auth-mode", "basic", "authentication mode, basic or token")
+	flag.StringVar(&tokenKey, "token-key", "", "PEM private key signing tokens (default: ephemeral key)")
+	flag.StringVar(&tokenIssuer, "token-issuer", "simple-reg", "issuer of tokens")
+	flag.StringVar(&tokenService, "token-service", "simple-reg", "service name tokens are issued for")
+	flag.StringVar(&tokenRealm, "token-realm", "", "token endpoint URL announced to clients (default: derived from the request)")
+	flag.StringVar(&policyPath, "policy", "", "YAML access policy mapping users and groups to repository permissions")
+	flag.Func("anonymous-pull", "repository `prefix` anonymous callers may pull from, * for all (repeatable)", func(value string) error {
+		anonymous = append(anonymous, value)
+		return nil
+	})
+	flag.StringVar(&robotsPath, "robots", "data/robots.json", "file storing robot accounts and their token hashes")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate file, enables TLS together with -tls-key (reloaded when changed)")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key file of the TLS certificate")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "minimum TLS version")
+	flag.StringVar(&tlsCiphers, "tls-cipher-suites", "", "comma separated TLS 1.2 cipher suites (default: Go's secure defaults)")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM CA bundle verifying client certificates, enables mutual TLS")
+	flag.StringVar(&tlsClientAuth, "tls-client-auth", "optional", "whether client certificates are optional or required")
+	flag.StringVar(&tlsClientIdentity, "tls-client-identity", authservice.CERT_FIELD_CN, "client certificate field used as identity: cn, email, dns or uri")
+	flag.DurationVar(&tokenExpiry, "token-expiry", authservice.DEFAULT_EXPIRY, "lifetime of issued tokens")
+	flag.Func("immutable-tag", "`<repository glob>=<tag regexp>` of tags that can never be moved (repeatable)", func(value string) error {
+		rule, err := manifestservice.ParseImmutableTagRule(value)
+		if err != nil {
+			return err
+		}
+		immutableTags = append(immutableTags, rule)
+		return nil
+	})
+	flag.Func("retention", "`<repository glob>=last:<n>,days:<n>,match:<tag regexp>` retention policy, first match wins (repeatable)", func(value string) error {
+		policy, err := manifestservice.ParseRetentionPolicy(value)
+		if err != nil {
+			return err
+		}
+		retention = append(retention, policy)
+		return nil
+	})
+	flag.DurationVar(&retentionTick, "retention-interval", time.Hour, "how often retention policies and blob garbage collection run")
+	flag.DurationVar(&uploadExpiry, "upload-expiry", simpleserver.UploadExpiry, "how long an upload session may go without a chunk before it is cancelled")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", server.DEFAULT_SHUTDOWN_TIMEOUT, "how long in-flight requests may take to finish on SIGTERM or SIGINT")
+	flag.StringVar(&webhooksPath, "webhooks", "", "YAML file of webhook endpoints notified about pushes, pulls, deletions and tag moves")
+	flag.StringVar(&webhookQueue, "webhook-queue", "data/webhooks", "directory queueing webhook deliveries until they succeed")
+	flag.StringVar(&auditLogPath, "audit-log", "", "file recording every push, upload, deletion and retag in a hash chain (default: disabled)")
+	flag.IntVar(&eventLogSize, "event-log-size", notificationservice.DEFAULT_EVENT_LOG_SIZE, "number of events /admin/events keeps for clients resuming a stream")
 	flag.Parse()
 
-	logger := zerolog.New(os.Stdout).
-		With().
-		Timestamp().
-		Logger().
-		Level(zerolog.ErrorLevel)
+	if err := loadConfig(); err != nil {
+		fatal(err)
+	}
+	if err := validateConfig(); err != nil {
+		fatal(fmt.Errorf("invalid configuration:\n%w", err))
+	}
+
+	logger := newLogger()
 
-	if isVerbose {
-		logger = logger.Level(zerolog.DebugLevel)
+	proxies, err := server.ParseTrustedProxies(strings.Split(trustedProxies, ",")...)
+	if err != nil {
+		fatal(err)
 	}
 
-	simpleserver.
+	simpleserver.BlobDir = blobDir
+	simpleserver.ManifestDir = manifestDir
+	simpleserver.MinFreeBytes = minFreeMB << 20
+	simpleserver.SetImmutableTags(immutableTags...)
+	simpleserver.SetQuotas(quotas...)
+	simpleserver.SetEventLogSize(eventLogSize)
+	if maxManifestSize > 0 {
+		simpleserver.MaxManifestSize = maxManifestSize
+	}
+	simpleserver.MaxBlobSize = maxBlobSize
+
+	svr := simpleserver.
 		New().
-		WithLogRequest().
-		WithPort(5000).
+		WithAccessLog(server.AccessLogOptions{Format: accessLogFormat, BodyLimit: accessLogBodies}).
+		WithTrustedProxies(proxies...).
+		WithPort(port).
+		WithAddr(listen).
 		WithLogger(logger).
-		ListenAndServe()
+		WithShutdownTimeout(shutdownTimeout).
+		WithTimeouts(server.Timeouts{
+			ReadHeader: readHeaderTimeout,
+			Read:       readTimeout,
+			Write:      writeTimeout,
+			Idle:       idleTimeout,
+		})
+
+	if metricsListen != "" {
+		svr.WithMetrics(metricsListen)
+	}
+
+	if otlpEndpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		if _, err := svr.WithTracing(server.TracingOptions{
+			Endpoint:    otlpEndpoint,
+			ServiceName: "simple-reg",
+			SampleRatio: traceSampleRatio,
+		}); err != nil {
+			logger.Fatal().Err(err).Msg("failed to set up tracing")
+		}
+	}
+
+	if auditLogPath != "" {
+		log, err := auditservice.Open(auditLogPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to open audit log")
+		}
+		// registered before retention so a last retention pass is still recorded
+		svr.WithShutdownHook(func(context.Context) error {
+			return log.Close()
+		})
+		simpleserver.SetAuditLog(log)
+	}
+
+	if webhooksPath != "" {
+		config, err := notificationservice.LoadWebhookConfig(webhooksPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load webhooks")
+		}
+		webhooks, err := notificationservice.NewWebhooks(config, webhookQueue, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to set up webhooks")
+		}
+		webhooks.Start()
+		// registered before retention so a last retention pass is still queued
+		svr.WithShutdownHook(webhooks.Close)
+		simpleserver.SetNotifiers(webhooks)
+	}
+
+	if len(retention) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			simpleserver.RunRetention(ctx, retentionTick, logger, retention...)
+		}()
+
+		// let a running retention pass finish before the upload files close
+		svr.WithShutdownHook(func(shutdownCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-shutdownCtx.Done():
+				return shutdownCtx.Err()
+			}
+		})
+	}
+
+	if uploadExpiry > 0 {
+		simpleserver.UploadExpiry = uploadExpiry
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			simpleserver.RunUploadExpiry(ctx, min(uploadExpiry, time.Hour), logger)
+		}()
+
+		svr.WithShutdownHook(func(shutdownCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-shutdownCtx.Done():
+				return shutdownCtx.Err()
+			}
+		})
+	}
+
+	if tlsCert != "" || tlsKey != "" || tlsClientCA != "" {
+		options, err := tlsOptions()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid TLS configuration")
+		}
+		svr.WithTLS(options)
+	}
+
+	if err := setupAccess(svr); err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up authentication")
+	}
+
+	svr.ListenAndServe()
+}
+
+// setupAccess installs the rate limits and the authentication the flags ask
+// for. Client IPs are limited before authentication so failed logins count,
+// users and repositories are only known after it.
+func setupAccess(svr *server.Server) error {
+	ipLimits, otherLimits := []server.RateLimit{}, []server.RateLimit{}
+	for _, limit := range rateLimits {
+		if limit.Scope == server.RATE_LIMIT_IP {
+			ipLimits = append(ipLimits, limit)
+		} else {
+			otherLimits = append(otherLimits, limit)
+		}
+	}
+	svr.WithRateLimits(ipLimits...)
+
+	if err := setupAuth(svr); err != nil {
+		return err
+	}
+
+	svr.WithRateLimits(otherLimits...)
+	return nil
+}
+
+func tlsOptions() (server.TLSOptions, error) {
+	if tlsCert == "" || tlsKey == "" {
+		return server.TLSOptions{}, errors.New("-tls-cert and -tls-key have to be set together, mutual TLS requires both")
+	}
+
+	minVersion, err := server.ParseTLSVersion(tlsMinVersion)
+	if err != nil {
+		return server.TLSOptions{}, err
+	}
+
+	cipherSuites, err := server.ParseCipherSuites(tlsCiphers)
+	if err != nil {
+		return server.TLSOptions{}, err
+	}
+
+	return server.TLSOptions{
+		CertFile:          tlsCert,
+		KeyFile:           tlsKey,
+		MinVersion:        minVersion,
+		CipherSuites:      cipherSuites,
+		ClientCAFile:      tlsClientCA,
+		RequireClientCert: tlsClientAuth == "require",
+	}, nil
 }
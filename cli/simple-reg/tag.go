@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type tagHistory struct {
+	Name    string `json:"name"`
+	Tag     string `json:"tag"`
+	History []struct {
+		Digest    string    `json:"digest"`
+		Timestamp time.Time `json:"timestamp"`
+		Pusher    string    `json:"pusher"`
+	} `json:"history"`
+}
+
+type tagRollback struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+func runTag(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: simple-reg tag <history|rollback> [flags] <name>:<tag>")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("tag "+args[0], flag.ExitOnError)
+	registry := flags.String("registry", "http://localhost:5000", "registry to talk to")
+	digest := flags.String("digest", "", "digest to roll back to (default: previous digest)")
+	flags.StringVar(&credentials, "user", "", "`user:password` to authenticate with")
+	flags.Parse(args[1:])
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: simple-reg tag %s [flags] <name>:<tag>\n", args[0])
+		os.Exit(2)
+	}
+
+	index := strings.LastIndex(flags.Arg(0), ":")
+	if index <= 0 {
+		fatal(fmt.Errorf("invalid reference %q, expected <name>:<tag>", flags.Arg(0)))
+	}
+	name, tag := flags.Arg(0)[:index], flags.Arg(0)[index+1:]
+	base := fmt.Sprintf("%s/admin/%s/tags/%s", strings.TrimSuffix(*registry, "/"), name, tag)
+
+	switch args[0] {
+	case "history":
+		var history tagHistory
+		if err := call(http.MethodGet, base+"/history", nil, &history); err != nil {
+			fatal(err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIMESTAMP\tDIGEST\tPUSHER")
+		for _, entry := range history.History {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", entry.Timestamp.Format(time.RFC3339), entry.Digest, entry.Pusher)
+		}
+		tw.Flush()
+	case "rollback":
+		query := url.Values{}
+		if *digest != "" {
+			query.Set("digest", *digest)
+		}
+
+		var rollback tagRollback
+		if err := call(http.MethodPost, base+"/rollback?"+query.Encode(), nil, &rollback); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s:%s now points at %s\n", rollback.Name, rollback.Tag, rollback.Digest)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown tag command %q\n", args[0])
+		os.Exit(2)
+	}
+}
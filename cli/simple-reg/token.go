@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type robot struct {
+	Name         string     `json:"name"`
+	Repositories []string   `json:"repositories"`
+	Actions      []string   `json:"actions"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+type createRobot struct {
+	Name         string   `json:"name"`
+	Repositories []string `json:"repositories"`
+	Actions      []string `json:"actions"`
+	ExpiresIn    int64    `json:"expires_in,omitempty"`
+}
+
+type createdRobot struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+func runToken(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: simple-reg token <create|list|revoke> [flags] [name]")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	registry := flags.String("registry", "http://localhost:5000", "registry to talk to")
+	repositories := flags.String("repositories", "", "comma separated repository globs the robot may access")
+	actions := flags.String("actions", "pull", "comma separated actions the robot may perform (pull, push, delete)")
+	expires := flags.Duration("expires", 0, "lifetime of the token (default: never expires)")
+	flags.StringVar(&credentials, "user", "", "`user:password` to authenticate with")
+	flags.Parse(args[1:])
+
+	base := strings.TrimSuffix(*registry, "/") + "/admin/robots"
+
+	switch args[0] {
+	case "create":
+		if flags.NArg() != 1 || *repositories == "" {
+			fmt.Fprintln(os.Stderr, "usage: simple-reg token create -repositories <globs> [flags] <name>")
+			os.Exit(2)
+		}
+
+		var created createdRobot
+		if err := call(http.MethodPost, base, createRobot{
+			Name:         flags.Arg(0),
+			Repositories: strings.Split(*repositories, ","),
+			Actions:      strings.Split(*actions, ","),
+			ExpiresIn:    int64(expires.Seconds()),
+		}, &created); err != nil {
+			fatal(err)
+		}
+
+		fmt.Printf("username: %s\ntoken:    %s\n", created.Username, created.Token)
+		fmt.Fprintln(os.Stderr, "store the token now, it cannot be shown again")
+	case "list":
+		var robots []robot
+		if err := call(http.MethodGet, base, nil, &robots); err != nil {
+			fatal(err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tREPOSITORIES\tACTIONS\tCREATED\tEXPIRES\tLAST USED")
+		for _, robot := range robots {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				robot.Name,
+				strings.Join(robot.Repositories, ","),
+				strings.Join(robot.Actions, ","),
+				robot.CreatedAt.Format(time.RFC3339),
+				formatTime(robot.ExpiresAt, "never"),
+				formatTime(robot.LastUsedAt, "never"),
+			)
+		}
+		tw.Flush()
+	case "revoke":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: simple-reg token revoke [flags] <name>")
+			os.Exit(2)
+		}
+
+		if err := call(http.MethodDelete, base+"/"+flags.Arg(0), nil, nil); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("robot %s revoked\n", flags.Arg(0))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown token command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func formatTime(t *time.Time, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// ACCESS_LOG_JSON logs requests through the server's logger.
+	ACCESS_LOG_JSON = "json"
+	// ACCESS_LOG_COMMON writes requests in the Common Log Format.
+	ACCESS_LOG_COMMON = "clf"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+type AccessLogOptions struct {
+	// Format is ACCESS_LOG_JSON, the default, or ACCESS_LOG_COMMON.
+	Format string
+	// Output receives the Common Log Format lines, by default stdout.
+	Output io.Writer
+	// BodyLimit is the number of bytes of request and response bodies added
+	// to JSON entries. Bodies are not logged when it is 0.
+	BodyLimit int
+}
+
+// WithAccessLog logs every request with the bytes sent and received, the
+// client, the authenticated user and the repository and digest it concerns.
+// Bodies are never buffered beyond options.BodyLimit.
+func (s *Server) WithAccessLog(options AccessLogOptions) *Server {
+	if options.Output == nil {
+		options.Output = os.Stdout
+	}
+
+	s.WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			body := &countingReader{ReadCloser: r.Body}
+			if options.BodyLimit > 0 && options.Format != ACCESS_LOG_COMMON {
+				rw.body = &cappedBuffer{limit: options.BodyLimit}
+				body.body = &cappedBuffer{limit: options.BodyLimit}
+			}
+			r.Body = body
+
+			next.ServeHTTP(rw, r)
+
+			if options.Format == ACCESS_LOG_COMMON {
+				writeCommonLog(options.Output, r, rw, start)
+				return
+			}
+			logRequest(r, rw, body, start)
+		})
+	})
+	return s
+}
+
+func logRequest(r *http.Request, rw *responseWriter, body *countingReader, start time.Time) {
+	event := Logger(r).Info()
+	if rw.statusCode >= 500 {
+		event = Logger(r).Error()
+	}
+
+	event.
+		Str("method", r.Method).
+		Str("url", fmt.Sprintf("%s://%s%s", GetScheme(r), r.Host, r.RequestURI)).
+		Int("status code", rw.statusCode).
+		Int64("duration", time.Since(start).Milliseconds()).
+		Int64("bytes sent", rw.written).
+		Int64("bytes received", body.read).
+		Str("client ip", ClientIP(r)).
+		Str("user agent", r.UserAgent())
+
+	addIfSet(event, "user", requestInfoFrom(r).user)
+	addIfSet(event, "repository", mux.Vars(r)["name"])
+	addIfSet(event, "digest", requestDigest(r, rw))
+	if body.body != nil {
+		event.Str("request body", body.body.String())
+		event.Str("response body", rw.body.String())
+	}
+
+	event.Msg("request")
+}
+
+func addIfSet(event *zerolog.Event, key, value string) {
+	if value != "" {
+		event.Str(key, value)
+	}
+}
+
+// writeCommonLog writes the request as
+// host ident authuser [date] "request line" status bytes.
+func writeCommonLog(out io.Writer, r *http.Request, rw *responseWriter, start time.Time) {
+	user := requestInfoFrom(r).user
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if rw.written > 0 {
+		size = fmt.Sprint(rw.written)
+	}
+
+	fmt.Fprintf(out, "%s - %s [%s] %q %d %s\n",
+		ClientIP(r),
+		user,
+		start.Format(clfTimeFormat),
+		fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto),
+		rw.statusCode,
+		size,
+	)
+}
+
+// requestDigest returns the digest of the blob or manifest r concerns.
+func requestDigest(r *http.Request, rw *responseWriter) string {
+	if digest := rw.Header().Get("Docker-Content-Digest"); digest != "" {
+		return digest
+	}
+	vars := mux.Vars(r)
+	if IsValidDigest(vars["digest"]) {
+		return vars["digest"]
+	}
+	if IsValidDigest(vars["reference"]) {
+		return vars["reference"]
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package auditservice
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ACTION_PUSH   = "push"
+	ACTION_UPLOAD = "upload"
+	ACTION_DELETE = "delete"
+	ACTION_RETAG  = "retag"
+)
+
+// Record is one line of the audit log. Hash is the SHA-256 of the record's
+// JSON encoding without Hash, Previous the Hash of the record before it, so
+// changing, removing or reordering records breaks the chain.
+type Record struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Repository string    `json:"repository"`
+	Reference  string    `json:"reference,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	// Identity is the authenticated user, Address the client IP.
+	Identity  string `json:"identity,omitempty"`
+	Address   string `json:"address,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Previous  string `json:"previous"`
+	Hash      string `json:"hash"`
+}
+
+// hash returns the hash record should carry.
+func (record Record) hash() (string, error) {
+	record.Hash = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends records to a file, one JSON object per line. Every record is
+// synced to disk before Append returns.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	last Record
+}
+
+// Open opens the audit log at path, creating it if needed, and continues
+// its chain.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := lastRecord(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Log{file: file, last: last}, nil
+}
+
+// lastRecord returns the final record of r, or the zero record if r is
+// empty.
+func lastRecord(r io.Reader) (Record, error) {
+	var last Record
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// refuse to chain onto a record cut short by a crash, it
+				// has to be inspected and removed by hand
+				return Record{}, errors.New("last record is incomplete")
+			}
+			return last, nil
+		}
+		if err != nil {
+			return Record{}, err
+		}
+		if err := json.Unmarshal(bytes.TrimSpace(line), &last); err != nil {
+			return Record{}, fmt.Errorf("record %d: %w", last.Seq+1, err)
+		}
+	}
+}
+
+// Append chains record to the log, setting its Seq, Time, Previous and
+// Hash.
+func (l *Log) Append(record Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record.Seq = l.last.Seq + 1
+	record.Time = time.Now().UTC()
+	record.Previous = l.last.Hash
+
+	var err error
+	if record.Hash, err = record.hash(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.last = record
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
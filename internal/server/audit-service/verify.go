@@ -0,0 +1,53 @@
+package auditservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrChainBroken = errors.New("audit chain broken")
+
+// Verify checks that every record of the audit log read from r carries its
+// own hash, follows on the record before it and has the next sequence
+// number. visit, if set, is called for every verified record. It returns
+// the last record, whose Hash anchors the whole log.
+func Verify(r io.Reader, visit func(Record)) (Record, error) {
+	var last Record
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(data) == 0 {
+			return last, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return last, err
+		}
+
+		var record Record
+		if err := json.Unmarshal(bytes.TrimSpace(data), &record); err != nil {
+			return last, fmt.Errorf("%w: line %d: %w", ErrChainBroken, line, err)
+		}
+
+		hash, err := record.hash()
+		if err != nil {
+			return last, err
+		}
+		switch {
+		case record.Hash != hash:
+			return last, fmt.Errorf("%w: line %d: record %d was modified", ErrChainBroken, line, record.Seq)
+		case record.Previous != last.Hash:
+			return last, fmt.Errorf("%w: line %d: record %d does not follow record %d", ErrChainBroken, line, record.Seq, last.Seq)
+		case record.Seq != last.Seq+1:
+			return last, fmt.Errorf("%w: line %d: record %d follows record %d", ErrChainBroken, line, record.Seq, last.Seq)
+		}
+
+		if visit != nil {
+			visit(record)
+		}
+		last = record
+	}
+}
@@ -0,0 +1,194 @@
+package auditservice
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLog appends a record per repository to a new log and returns its
+// lines and the hash of the last record.
+func writeLog(t *testing.T, repos ...string) ([]string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range repos {
+		if err := log.Append(Record{Action: ACTION_PUSH, Repository: repo, Reference: "latest"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	anchor := log.last.Hash
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(string(data), "\n"), anchor
+}
+
+// rewrite changes the record of line with change, rehashing it if asked.
+func rewrite(t *testing.T, line string, rehash bool, change func(*Record)) string {
+	t.Helper()
+	var record Record
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatal(err)
+	}
+	change(&record)
+	if rehash {
+		var err error
+		if record.Hash, err = record.hash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data) + "\n"
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, lines []string) []string
+		// broken is whether Verify reports a broken chain, anchored whether
+		// the last verified record still matches the hash of the log
+		broken   bool
+		anchored bool
+		visited  int
+	}{
+		{
+			name:     "intact",
+			tamper:   func(t *testing.T, lines []string) []string { return lines },
+			anchored: true,
+			visited:  3,
+		},
+		{
+			name: "modified record",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1] = rewrite(t, lines[1], false, func(r *Record) { r.Repository = "other" })
+				return lines
+			},
+			broken:  true,
+			visited: 1,
+		},
+		{
+			name: "modified and rehashed record",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1] = rewrite(t, lines[1], true, func(r *Record) { r.Identity = "mallory" })
+				return lines
+			},
+			broken:  true,
+			visited: 2,
+		},
+		{
+			name: "renumbered record",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[2] = rewrite(t, lines[2], true, func(r *Record) { r.Seq = 7 })
+				return lines
+			},
+			broken:  true,
+			visited: 2,
+		},
+		{
+			name: "removed record",
+			tamper: func(t *testing.T, lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			broken:  true,
+			visited: 1,
+		},
+		{
+			name: "reordered records",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			broken:  true,
+			visited: 1,
+		},
+		{
+			name: "record cut short",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[2] = lines[2][:len(lines[2])/2]
+				return lines
+			},
+			broken:  true,
+			visited: 2,
+		},
+		{
+			// a log truncated between records is a valid chain, only the
+			// anchor reveals the missing records
+			name: "truncated log",
+			tamper: func(t *testing.T, lines []string) []string {
+				return lines[:2]
+			},
+			visited: 2,
+		},
+		{
+			name:    "emptied log",
+			tamper:  func(t *testing.T, lines []string) []string { return nil },
+			visited: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, anchor := writeLog(t, "a", "b", "c")
+			data := strings.Join(test.tamper(t, lines), "")
+
+			visited := 0
+			last, err := Verify(strings.NewReader(data), func(Record) { visited++ })
+			if errors.Is(err, ErrChainBroken) != test.broken {
+				t.Errorf("Verify returned %v, want broken %t", err, test.broken)
+			}
+			if anchored := last.Hash == anchor; anchored != test.anchored {
+				t.Errorf("last record %d anchored %t, want %t", last.Seq, anchored, test.anchored)
+			}
+			if visited != test.visited {
+				t.Errorf("visited %d records, want %d", visited, test.visited)
+			}
+		})
+	}
+}
+
+func TestOpenContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, repo := range []string{"a", "b"} {
+		log, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := log.Append(Record{Action: ACTION_PUSH, Repository: repo}); err != nil {
+			t.Fatal(err)
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if last, err := Verify(file, nil); err != nil || last.Seq != 2 {
+		t.Errorf("Verify = record %d, %v, want record 2", last.Seq, err)
+	}
+
+	// a record cut short by a crash is not chained onto
+	if err := os.WriteFile(path, []byte(`{"seq":1,"act`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Open accepted a log ending in an incomplete record")
+	}
+}
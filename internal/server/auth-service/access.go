@@ -0,0 +1,114 @@
+package authservice
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+const (
+	ACTION_PULL   = "pull"
+	ACTION_PUSH   = "push"
+	ACTION_DELETE = "delete"
+	ACTION_ADMIN  = "*"
+
+	TYPE_REPOSITORY = "repository"
+	TYPE_REGISTRY   = "registry"
+	CATALOG         = "catalog"
+	ADMIN           = "admin"
+)
+
+// Access is a resource and the actions requested or granted on it, as used
+// in the scopes of the Docker token authentication.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+func (a Access) String() string {
+	return fmt.Sprintf("%s:%s:%s", a.Type, a.Name, strings.Join(a.Actions, ","))
+}
+
+// Allows reports whether a grants action on the resource of required.
+func (a Access) Allows(required Access, action string) bool {
+	if a.Type != required.Type || a.Name != required.Name {
+		return false
+	}
+	return slices.Contains(a.Actions, action) || slices.Contains(a.Actions, ACTION_ADMIN)
+}
+
+// ParseScope parses a space separated list of scopes such as
+// "repository:foo/bar:pull,push registry:catalog:*".
+func ParseScope(scope string) ([]Access, error) {
+	accesses := make([]Access, 0)
+	for _, s := range strings.Fields(scope) {
+		typ, rest, ok := strings.Cut(s, ":")
+		index := strings.LastIndex(rest, ":")
+		if !ok || index <= 0 {
+			return nil, fmt.Errorf("invalid scope %q", s)
+		}
+
+		accesses = append(accesses, Access{
+			Type:    typ,
+			Name:    rest[:index],
+			Actions: strings.Split(rest[index+1:], ","),
+		})
+	}
+	return accesses, nil
+}
+
+// RequiredAccess returns the access r needs and the action within it. It
+// returns false for routes that only require the caller to be
+// authenticated, such as the API version check.
+func RequiredAccess(r *http.Request) (Access, string, bool) {
+	template := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	name, hasName := mux.Vars(r)["name"]
+
+	switch {
+	case strings.HasPrefix(template, "/admin/") && hasName:
+		return Access{Type: TYPE_REPOSITORY, Name: name, Actions: []string{ACTION_ADMIN}}, ACTION_ADMIN, true
+	case strings.HasPrefix(template, "/admin/"):
+		return Access{Type: TYPE_REGISTRY, Name: ADMIN, Actions: []string{ACTION_ADMIN}}, ACTION_ADMIN, true
+	case !hasName && strings.HasSuffix(template, "/tags/list"):
+		return Access{Type: TYPE_REGISTRY, Name: CATALOG, Actions: []string{ACTION_ADMIN}}, ACTION_ADMIN, true
+	case !hasName:
+		return Access{}, "", false
+	}
+
+	action := ACTION_PULL
+	switch r.Method {
+	case http.MethodPost, http.MethodPatch, http.MethodPut:
+		action = ACTION_PUSH
+	case http.MethodDelete:
+		action = ACTION_DELETE
+	}
+	return Access{Type: TYPE_REPOSITORY, Name: name, Actions: []string{action}}, action, true
+}
+
+// IsAdminRoute reports whether r is for an admin route, which requires the
+// admin permission on the repository or, for registry wide routes, on every
+// repository.
+func IsAdminRoute(r *http.Request) bool {
+	required, action, ok := RequiredAccess(r)
+	return ok && action == ACTION_ADMIN && (required.Type == TYPE_REPOSITORY || required.Name == ADMIN)
+}
+
+// DenyAdmin denies every admin route. It guards them when no policy grants
+// the admin permission, every other request is passed on.
+func DenyAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsAdminRoute(r) {
+			server.WriteErrors(w, r, server.ERROR_DENIED)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
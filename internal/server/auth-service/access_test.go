@@ -0,0 +1,69 @@
+package authservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDenyAdmin(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(DenyAdmin)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, path := range []string{
+		"/v2/",
+		"/v2/tags/list",
+		"/v2/{name:.+}/tags/list",
+		"/v2/{name:.+}/manifests/{reference:.+}",
+		"/admin/usage",
+		"/admin/robots",
+		"/admin/{name:.+}/usage",
+		"/admin/{name:.+}/tags/{tag}/rollback",
+	} {
+		router.HandleFunc(path, ok)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/v2/", http.StatusOK},
+		{http.MethodGet, "/v2/tags/list", http.StatusOK},
+		{http.MethodGet, "/v2/team/app/tags/list", http.StatusOK},
+		{http.MethodPut, "/v2/team/app/manifests/latest", http.StatusOK},
+		{http.MethodGet, "/admin/usage", http.StatusForbidden},
+		{http.MethodPost, "/admin/robots", http.StatusForbidden},
+		{http.MethodGet, "/admin/team/app/usage", http.StatusForbidden},
+		{http.MethodPost, "/admin/team/app/tags/latest/rollback", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %s answered %d, want %d", test.method, test.path, w.Code, test.status)
+		}
+	}
+}
+
+func TestAuthenticatedOnly(t *testing.T) {
+	tests := []struct {
+		user    string
+		access  Access
+		granted []string
+	}{
+		{"", Access{TYPE_REPOSITORY, "app", []string{ACTION_PULL}}, nil},
+		{"alice", Access{TYPE_REPOSITORY, "app", []string{ACTION_PULL, ACTION_PUSH}}, []string{ACTION_PULL, ACTION_PUSH}},
+		{"alice", Access{TYPE_REPOSITORY, "app", []string{ACTION_PULL, ACTION_ADMIN}}, []string{ACTION_PULL}},
+		{"alice", Access{TYPE_REGISTRY, CATALOG, []string{ACTION_ADMIN}}, []string{ACTION_ADMIN}},
+		{"alice", Access{TYPE_REGISTRY, ADMIN, []string{ACTION_ADMIN}}, nil},
+	}
+	for _, test := range tests {
+		if got := AuthenticatedOnly(test.user, test.access); !slices.Equal(got, test.granted) {
+			t.Errorf("AuthenticatedOnly(%q, %s) = %v, want %v", test.user, test.access, got, test.granted)
+		}
+	}
+}
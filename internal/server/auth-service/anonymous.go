@@ -0,0 +1,95 @@
+package authservice
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// ALL_REPOSITORIES as prefix opens every repository for anonymous pulls.
+const ALL_REPOSITORIES = "*"
+
+// AnonymousPull opens the read routes (GET and HEAD on blobs, manifests and
+// tags) of repositories below the configured prefixes to unauthenticated
+// callers, while every write still requires credentials.
+type AnonymousPull struct {
+	prefixes []string
+}
+
+func NewAnonymousPull(prefixes ...string) *AnonymousPull {
+	return &AnonymousPull{prefixes: prefixes}
+}
+
+// Covers reports whether repo lies below one of the anonymous prefixes.
+func (a *AnonymousPull) Covers(repo string) bool {
+	return slices.ContainsFunc(a.prefixes, func(prefix string) bool {
+		prefix = strings.TrimSuffix(prefix, "/")
+		return prefix == ALL_REPOSITORIES || repo == prefix || strings.HasPrefix(repo, prefix+"/")
+	})
+}
+
+// isPublicRead reports whether r is a pull of a covered repository or the
+// API version check, which has to succeed for clients to pull anonymously.
+func (a *AnonymousPull) isPublicRead(r *http.Request) bool {
+	if len(a.prefixes) == 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	_, _, needsAccess := RequiredAccess(r)
+	return a.isPublicRepositoryRead(r) || (!needsAccess && r.URL.Path != TOKEN_PATH)
+}
+
+func (a *AnonymousPull) isPublicRepositoryRead(r *http.Request) bool {
+	if len(a.prefixes) == 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	required, action, needsAccess := RequiredAccess(r)
+	return needsAccess && required.Type == TYPE_REPOSITORY && action == ACTION_PULL && a.Covers(required.Name)
+}
+
+// Authentication lets public reads without credentials skip the
+// authentication middleware. Callers presenting credentials are still
+// authenticated, so a wrong password is rejected.
+func (a *AnonymousPull) Authentication(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" && a.isPublicRead(r) {
+				next.ServeHTTP(w, server.WithRepositoryFilter(r, a.Covers))
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Authorization lets pulls of covered repositories skip the authorization
+// middleware.
+func (a *AnonymousPull) Authorization(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authorized := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a.isPublicRepositoryRead(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authorized.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Authorizer wraps next so tokens of every caller, anonymous or not, grant
+// pull on covered repositories.
+func (a *AnonymousPull) Authorizer(next Authorizer) Authorizer {
+	return func(user string, access Access) []string {
+		granted := next(user, access)
+		if access.Type == TYPE_REPOSITORY && a.Covers(access.Name) &&
+			slices.Contains(access.Actions, ACTION_PULL) && !slices.Contains(granted, ACTION_PULL) {
+			granted = append(granted, ACTION_PULL)
+		}
+		return granted
+	}
+}
@@ -0,0 +1,45 @@
+package authservice
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// Authenticator checks the credentials of a user.
+type Authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// Authenticators accepts credentials any of its authenticators accepts.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(user, password string) bool {
+	for _, authenticator := range a {
+		if authenticator.Authenticate(user, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicAuth returns a middleware accepting only requests carrying
+// credentials the authenticator accepts. Unauthenticated requests are
+// answered with a basic challenge for realm, which is what `docker login`
+// expects.
+func BasicAuth(realm string, authenticator Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || !authenticator.Authenticate(user, password) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+				server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+				return
+			}
+
+			next.ServeHTTP(w, server.WithUser(r, user))
+		})
+	}
+}
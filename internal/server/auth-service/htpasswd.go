@@ -0,0 +1,56 @@
+package authservice
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so a failed login takes
+// as long for unknown users as for known ones.
+var dummyHash = []byte("$2a$10$X9YnpX9AI.4tYlSX0a0vx.fYUjxYAUT6d6XVP15JRDoWMurYUPhcO")
+
+// Htpasswd holds bcrypt hashed credentials as written by `htpasswd -B`.
+type Htpasswd struct {
+	users map[string][]byte
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	htpasswd := &Htpasswd{users: map[string][]byte{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: invalid entry", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported", path, line)
+		}
+		htpasswd.users[user] = []byte(hash)
+	}
+
+	return htpasswd, scanner.Err()
+}
+
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
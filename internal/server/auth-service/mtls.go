@@ -0,0 +1,76 @@
+package authservice
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+const (
+	CERT_FIELD_CN    = "cn"
+	CERT_FIELD_EMAIL = "email"
+	CERT_FIELD_DNS   = "dns"
+	CERT_FIELD_URI   = "uri"
+)
+
+func ValidateCertificateField(field string) error {
+	switch field {
+	case CERT_FIELD_CN, CERT_FIELD_EMAIL, CERT_FIELD_DNS, CERT_FIELD_URI:
+		return nil
+	}
+	return fmt.Errorf("unknown certificate identity field %q", field)
+}
+
+// CertificateIdentity returns the identity of a client certificate: its
+// subject common name or its first email, DNS or URI subject alternative
+// name.
+func CertificateIdentity(cert *x509.Certificate, field string) string {
+	switch field {
+	case CERT_FIELD_CN:
+		return cert.Subject.CommonName
+	case CERT_FIELD_EMAIL:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CERT_FIELD_DNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CERT_FIELD_URI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// ClientCertificate wraps an authentication middleware so callers presenting
+// a client certificate verified during the TLS handshake are authenticated
+// as the identity taken from field. Every other request is handed to
+// middleware, or denied when middleware is nil.
+func ClientCertificate(field string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		var fallback http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+		})
+		if middleware != nil {
+			fallback = middleware(next)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+
+			identity := CertificateIdentity(r.TLS.VerifiedChains[0][0], field)
+			if identity == "" || IsRobot(identity) {
+				server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+				return
+			}
+			next.ServeHTTP(w, server.WithUser(r, identity))
+		})
+	}
+}
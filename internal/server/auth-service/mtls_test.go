@@ -0,0 +1,53 @@
+package authservice
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+func TestClientCertificate(t *testing.T) {
+	withCertificate := func(cn string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		return r
+	}
+	fallback := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, server.WithUser(r, "fallback"))
+		})
+	}
+
+	tests := []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+		request    *http.Request
+		status     int
+		user       string
+	}{
+		{"certificate", nil, withCertificate("builder"), http.StatusOK, "builder"},
+		{"certificate over fallback", fallback, withCertificate("builder"), http.StatusOK, "builder"},
+		{"robot name", fallback, withCertificate("robot$ci"), http.StatusUnauthorized, ""},
+		{"no certificate with fallback", fallback, httptest.NewRequest(http.MethodGet, "/v2/", nil), http.StatusOK, "fallback"},
+		{"no certificate without fallback", nil, httptest.NewRequest(http.MethodGet, "/v2/", nil), http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := ""
+			handler := ClientCertificate(CERT_FIELD_CN, test.middleware)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user, _ = server.UserFromRequest(r)
+			}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, test.request)
+			if w.Code != test.status || user != test.user {
+				t.Errorf("answered %d as %q, want %d as %q", w.Code, user, test.status, test.user)
+			}
+		})
+	}
+}
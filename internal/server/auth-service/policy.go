@@ -0,0 +1,203 @@
+package authservice
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PERMISSION_PULL   = "pull"
+	PERMISSION_PUSH   = "push"
+	PERMISSION_DELETE = "delete"
+	PERMISSION_ADMIN  = "admin"
+
+	// SUBJECT_AUTHENTICATED matches every authenticated user.
+	SUBJECT_AUTHENTICATED = "*"
+	// SUBJECT_ANONYMOUS matches callers without credentials.
+	SUBJECT_ANONYMOUS = "anonymous"
+	// GROUP_PREFIX marks a subject as a group defined in the policy.
+	GROUP_PREFIX = "group:"
+)
+
+// Policy maps users and groups to the permissions they hold on repositories.
+//
+//	groups:
+//	  devs: [alice, bob]
+//	rules:
+//	  - subjects: [group:devs]
+//	    repositories: ["team-a/**"]
+//	    permissions: [pull, push]
+//	  - subjects: ["*"]
+//	    repositories: ["library/*"]
+//	    permissions: [pull]
+type Policy struct {
+	Groups map[string][]string `yaml:"groups"`
+	Rules  []PolicyRule        `yaml:"rules"`
+}
+
+// PolicyRule grants Permissions on Repositories to Subjects. Repositories
+// are path.Match globs, a trailing "/**" matches a namespace at any depth
+// and "**" matches every repository.
+type PolicyRule struct {
+	Subjects     []string `yaml:"subjects"`
+	Repositories []string `yaml:"repositories"`
+	Permissions  []string `yaml:"permissions"`
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+func (p *Policy) Validate() error {
+	for i, rule := range p.Rules {
+		for _, permission := range rule.Permissions {
+			switch permission {
+			case PERMISSION_PULL, PERMISSION_PUSH, PERMISSION_DELETE, PERMISSION_ADMIN:
+			default:
+				return fmt.Errorf("rule %d: unknown permission %q", i+1, permission)
+			}
+		}
+		for _, pattern := range rule.Repositories {
+			if err := server.ValidateRepositoryGlob(pattern); err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		}
+		for _, subject := range rule.Subjects {
+			if group, ok := strings.CutPrefix(subject, GROUP_PREFIX); ok {
+				if _, ok := p.Groups[group]; !ok {
+					return fmt.Errorf("rule %d: unknown group %q", i+1, group)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Policy) appliesTo(rule PolicyRule, user string) bool {
+	for _, subject := range rule.Subjects {
+		switch {
+		case subject == SUBJECT_ANONYMOUS && user == "",
+			subject == SUBJECT_AUTHENTICATED && user != "",
+			subject == user && user != "":
+			return true
+		}
+		if group, ok := strings.CutPrefix(subject, GROUP_PREFIX); ok && user != "" && slices.Contains(p.Groups[group], user) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether user holds permission on repo. Admin implies every
+// other permission, an empty user is an anonymous caller.
+func (p *Policy) Can(user, repo, permission string) bool {
+	for _, rule := range p.Rules {
+		if !p.appliesTo(rule, user) {
+			continue
+		}
+		if !slices.ContainsFunc(rule.Repositories, func(pattern string) bool {
+			return server.MatchRepository(pattern, repo)
+		}) {
+			continue
+		}
+		if slices.Contains(rule.Permissions, permission) || slices.Contains(rule.Permissions, PERMISSION_ADMIN) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether user holds the admin permission on every
+// repository, which is required for registry wide admin routes.
+func (p *Policy) IsAdmin(user string) bool {
+	return slices.ContainsFunc(p.Rules, func(rule PolicyRule) bool {
+		return p.appliesTo(rule, user) &&
+			slices.Contains(rule.Permissions, PERMISSION_ADMIN) &&
+			slices.Contains(rule.Repositories, "**")
+	})
+}
+
+func (p *Policy) knows(user string) bool {
+	return slices.ContainsFunc(p.Rules, func(rule PolicyRule) bool {
+		return p.appliesTo(rule, user)
+	})
+}
+
+// permission maps a token action to the policy permission it requires.
+func permission(action string) string {
+	if action == ACTION_ADMIN {
+		return PERMISSION_ADMIN
+	}
+	return action
+}
+
+// Authorizer grants the requested actions the policy allows, so tokens only
+// carry scopes the caller actually holds. The catalog is granted to every
+// caller the policy knows, listings are filtered by the middleware.
+func (p *Policy) Authorizer(user string, access Access) []string {
+	if access.Type == TYPE_REGISTRY {
+		if (access.Name == CATALOG && p.knows(user)) || (access.Name == ADMIN && p.IsAdmin(user)) {
+			return access.Actions
+		}
+		return nil
+	}
+
+	granted := make([]string, 0, len(access.Actions))
+	for _, action := range access.Actions {
+		if p.Can(user, access.Name, permission(action)) {
+			granted = append(granted, action)
+		}
+	}
+	return granted
+}
+
+// Middleware enforces the policy on every route. It has to run after the
+// authentication middleware so the caller is known. Repository listings are
+// filtered to what the caller may pull.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := server.UserFromRequest(r)
+		r = server.WithRepositoryFilter(r, func(repo string) bool {
+			return p.Can(user, repo, PERMISSION_PULL)
+		})
+
+		required, action, needsAccess := RequiredAccess(r)
+		allowed := true
+		switch {
+		case !needsAccess:
+		case required.Type == TYPE_REPOSITORY:
+			allowed = p.Can(user, required.Name, permission(action))
+		case required.Name == ADMIN:
+			allowed = p.IsAdmin(user)
+		}
+
+		if !allowed {
+			if user == "" {
+				server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+				return
+			}
+			server.WriteErrors(w, r, server.ERROR_DENIED)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
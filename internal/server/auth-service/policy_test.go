@@ -0,0 +1,65 @@
+package authservice
+
+import "testing"
+
+func TestPolicyCan(t *testing.T) {
+	policy := &Policy{
+		Groups: map[string][]string{"devs": {"alice", "bob"}},
+		Rules: []PolicyRule{
+			{Subjects: []string{GROUP_PREFIX + "devs"}, Repositories: []string{"team-a/**"}, Permissions: []string{PERMISSION_PULL, PERMISSION_PUSH}},
+			{Subjects: []string{SUBJECT_AUTHENTICATED}, Repositories: []string{"library/*"}, Permissions: []string{PERMISSION_PULL}},
+			{Subjects: []string{SUBJECT_ANONYMOUS}, Repositories: []string{"public/*"}, Permissions: []string{PERMISSION_PULL}},
+			{Subjects: []string{"carol"}, Repositories: []string{"team-a/app", "tools"}, Permissions: []string{PERMISSION_ADMIN}},
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user       string
+		repo       string
+		permission string
+		allowed    bool
+	}{
+		{"alice", "team-a/app", PERMISSION_PULL, true},
+		{"bob", "team-a/sub/app", PERMISSION_PUSH, true},
+		{"alice", "team-a/app", PERMISSION_DELETE, false},
+		{"alice", "team-b/app", PERMISSION_PULL, false},
+		{"dave", "team-a/app", PERMISSION_PULL, false},
+		{"dave", "library/nginx", PERMISSION_PULL, true},
+		{"dave", "library/nginx", PERMISSION_PUSH, false},
+		{"", "library/nginx", PERMISSION_PULL, false},
+		{"", "public/nginx", PERMISSION_PULL, true},
+		{"alice", "public/nginx", PERMISSION_PULL, false},
+		{"carol", "team-a/app", PERMISSION_DELETE, true},
+		{"carol", "team-a/app", PERMISSION_ADMIN, true},
+		{"carol", "tools", PERMISSION_PUSH, true},
+		{"carol", "team-a/other", PERMISSION_PULL, false},
+		{"", "team-a/app", PERMISSION_PULL, false},
+	}
+	for _, test := range tests {
+		if allowed := policy.Can(test.user, test.repo, test.permission); allowed != test.allowed {
+			t.Errorf("Can(%q, %q, %q) = %t, want %t", test.user, test.repo, test.permission, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  PolicyRule
+		valid bool
+	}{
+		{"valid", PolicyRule{Subjects: []string{GROUP_PREFIX + "devs"}, Repositories: []string{"team/**"}, Permissions: []string{PERMISSION_PULL}}, true},
+		{"unknown permission", PolicyRule{Subjects: []string{"alice"}, Repositories: []string{"app"}, Permissions: []string{"write"}}, false},
+		{"invalid glob", PolicyRule{Subjects: []string{"alice"}, Repositories: []string{"team/[/**"}, Permissions: []string{PERMISSION_PULL}}, false},
+		{"unknown group", PolicyRule{Subjects: []string{GROUP_PREFIX + "ops"}, Repositories: []string{"app"}, Permissions: []string{PERMISSION_PULL}}, false},
+	}
+	for _, test := range tests {
+		policy := &Policy{Groups: map[string][]string{"devs": {"alice"}}, Rules: []PolicyRule{test.rule}}
+		if err := policy.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
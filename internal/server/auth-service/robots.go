@@ -0,0 +1,421 @@
+package authservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// ROBOT_PREFIX prefixes the user name robots authenticate with.
+	ROBOT_PREFIX = "robot$"
+	// TOKEN_PREFIX prefixes every robot token so leaked tokens are easy to spot.
+	TOKEN_PREFIX = "srt_"
+	// lastUsedResolution limits how often a robot's last use is persisted.
+	lastUsedResolution = time.Minute
+)
+
+var (
+	ErrRobotExists  = errors.New("robot already exists")
+	ErrRobotUnknown = errors.New("robot unknown")
+
+	robotNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// Robot is a CI account authenticating with a long-lived token instead of a
+// password. It may only perform Actions on Repositories, which are globs as
+// understood by server.MatchRepository.
+type Robot struct {
+	Name         string     `json:"name"`
+	Repositories []string   `json:"repositories"`
+	Actions      []string   `json:"actions"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	TokenHash    string     `json:"token_hash,omitempty"`
+}
+
+// Allows reports whether the robot may perform action on repo.
+func (robot Robot) Allows(repo, action string) bool {
+	return slices.Contains(robot.Actions, action) && slices.ContainsFunc(robot.Repositories, func(pattern string) bool {
+		return server.MatchRepository(pattern, repo)
+	})
+}
+
+// RobotStore persists robots in a JSON file. Only the SHA-256 of each token
+// is stored, the token itself is shown once when the robot is created.
+type RobotStore struct {
+	sync.Mutex
+	path   string
+	robots map[string]*Robot
+	log    zerolog.Logger
+	// saving is set while a save of the last uses is pending
+	saving  bool
+	pending sync.WaitGroup
+}
+
+func LoadRobotStore(path string) (*RobotStore, error) {
+	store := &RobotStore{path: path, robots: map[string]*Robot{}, log: zerolog.Nop()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	robots := make([]*Robot, 0)
+	if err := json.Unmarshal(data, &robots); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, robot := range robots {
+		store.robots[robot.Name] = robot
+	}
+	return store, nil
+}
+
+// WithLogger logs failures to record the use of a robot to logger.
+func (rs *RobotStore) WithLogger(logger zerolog.Logger) *RobotStore {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.log = logger
+	return rs
+}
+
+// save writes the store atomically. The caller has to hold the lock.
+func (rs *RobotStore) save() error {
+	robots := make([]*Robot, 0, len(rs.robots))
+	for _, robot := range rs.robots {
+		robots = append(robots, robot)
+	}
+	sort.Slice(robots, func(i, j int) bool { return robots[i].Name < robots[j].Name })
+
+	data, err := json.MarshalIndent(robots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rs.path), 0755); err != nil {
+		return err
+	}
+	tmp := rs.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rs.path)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create adds a robot and returns its token.
+func (rs *RobotStore) Create(robot Robot) (string, error) {
+	if !robotNameRegexp.MatchString(robot.Name) {
+		return "", fmt.Errorf("invalid robot name %q", robot.Name)
+	}
+	if len(robot.Repositories) == 0 || len(robot.Actions) == 0 {
+		return "", errors.New("robot needs at least one repository and one action")
+	}
+	for _, action := range robot.Actions {
+		if action != ACTION_PULL && action != ACTION_PUSH && action != ACTION_DELETE {
+			return "", fmt.Errorf("invalid robot action %q", action)
+		}
+	}
+	for _, pattern := range robot.Repositories {
+		if err := server.ValidateRepositoryGlob(pattern); err != nil {
+			return "", err
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(secret)
+
+	rs.Lock()
+	defer rs.Unlock()
+
+	if _, ok := rs.robots[robot.Name]; ok {
+		return "", ErrRobotExists
+	}
+
+	robot.CreatedAt = time.Now().UTC()
+	robot.LastUsedAt = nil
+	robot.TokenHash = hashToken(token)
+	rs.robots[robot.Name] = &robot
+
+	if err := rs.save(); err != nil {
+		delete(rs.robots, robot.Name)
+		return "", err
+	}
+	return token, nil
+}
+
+// List returns every robot without its token hash.
+func (rs *RobotStore) List() []Robot {
+	rs.Lock()
+	defer rs.Unlock()
+
+	robots := make([]Robot, 0, len(rs.robots))
+	for _, robot := range rs.robots {
+		listed := *robot
+		listed.TokenHash = ""
+		robots = append(robots, listed)
+	}
+	sort.Slice(robots, func(i, j int) bool { return robots[i].Name < robots[j].Name })
+	return robots
+}
+
+// Revoke deletes the robot name, invalidating its token immediately.
+func (rs *RobotStore) Revoke(name string) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	robot, ok := rs.robots[name]
+	if !ok {
+		return ErrRobotUnknown
+	}
+
+	delete(rs.robots, name)
+	if err := rs.save(); err != nil {
+		rs.robots[name] = robot
+		return err
+	}
+	return nil
+}
+
+// Authenticate accepts "robot$<name>" with the robot's token and records
+// the use. The use is saved in the background, at most once per
+// lastUsedResolution and robot.
+func (rs *RobotStore) Authenticate(user, password string) bool {
+	name, ok := strings.CutPrefix(user, ROBOT_PREFIX)
+	if !ok {
+		return false
+	}
+
+	rs.Lock()
+	defer rs.Unlock()
+
+	robot, ok := rs.robots[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(robot.TokenHash), []byte(hashToken(password))) != 1 {
+		return false
+	}
+
+	now := time.Now().UTC()
+	if robot.ExpiresAt != nil && now.After(*robot.ExpiresAt) {
+		return false
+	}
+
+	if robot.LastUsedAt == nil || now.Sub(*robot.LastUsedAt) >= lastUsedResolution {
+		robot.LastUsedAt = &now
+		rs.saveLater()
+	}
+	return true
+}
+
+// saveLater saves the store in the background, so recording the use of a
+// robot does not hold up its request. A save still pending picks up later
+// changes. The caller has to hold the lock.
+func (rs *RobotStore) saveLater() {
+	if rs.saving {
+		return
+	}
+	rs.saving = true
+	rs.pending.Add(1)
+	go func() {
+		defer rs.pending.Done()
+		rs.Lock()
+		defer rs.Unlock()
+		rs.saving = false
+		if err := rs.save(); err != nil {
+			rs.log.Error().Err(err).Str("file", rs.path).Msg("failed to record robot use")
+		}
+	}()
+}
+
+// Close waits for the pending save of the last uses.
+func (rs *RobotStore) Close() {
+	rs.pending.Wait()
+}
+
+func (rs *RobotStore) robot(user string) (Robot, bool) {
+	name, ok := strings.CutPrefix(user, ROBOT_PREFIX)
+	if !ok {
+		return Robot{}, false
+	}
+
+	rs.Lock()
+	defer rs.Unlock()
+
+	robot, ok := rs.robots[name]
+	if !ok {
+		return Robot{}, false
+	}
+	return *robot, true
+}
+
+// IsRobot reports whether user names a robot account.
+func IsRobot(user string) bool {
+	return strings.HasPrefix(user, ROBOT_PREFIX)
+}
+
+// Authorization enforces the scopes of robots instead of middleware, which
+// keeps authorizing every other caller. Robots never get admin access and
+// only see the repositories they may pull in listings.
+func (rs *RobotStore) Authorization(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authorized := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _ := server.UserFromRequest(r)
+			if !IsRobot(user) {
+				authorized.ServeHTTP(w, r)
+				return
+			}
+
+			robot, ok := rs.robot(user)
+			if !ok {
+				server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+				return
+			}
+
+			r = server.WithRepositoryFilter(r, func(repo string) bool {
+				return robot.Allows(repo, ACTION_PULL)
+			})
+
+			required, action, needsAccess := RequiredAccess(r)
+			if needsAccess && (required.Type != TYPE_REPOSITORY || !robot.Allows(required.Name, action)) &&
+				!(required.Type == TYPE_REGISTRY && required.Name == CATALOG) {
+				server.WriteErrors(w, r, server.ERROR_DENIED)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Authorizer wraps next so tokens issued to robots carry the requested
+// actions within the robot's scopes only.
+func (rs *RobotStore) Authorizer(next Authorizer) Authorizer {
+	return func(user string, access Access) []string {
+		if !IsRobot(user) {
+			return next(user, access)
+		}
+
+		robot, ok := rs.robot(user)
+		if !ok {
+			return nil
+		}
+		if access.Type == TYPE_REGISTRY {
+			if access.Name == CATALOG {
+				return access.Actions
+			}
+			return nil
+		}
+
+		granted := make([]string, 0, len(access.Actions))
+		for _, action := range access.Actions {
+			if robot.Allows(access.Name, action) {
+				granted = append(granted, action)
+			}
+		}
+		return granted
+	}
+}
+
+// CreateRobotRequest is the body of a robot creation. ExpiresIn is given in
+// seconds, robots without it never expire.
+type CreateRobotRequest struct {
+	Name         string   `json:"name"`
+	Repositories []string `json:"repositories"`
+	Actions      []string `json:"actions"`
+	ExpiresIn    int64    `json:"expires_in,omitempty"`
+}
+
+type CreateRobotResponse struct {
+	Robot
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+func (rs *RobotStore) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	var request CreateRobotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		server.WriteErrors(w, r, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+	defer r.Body.Close()
+
+	robot := Robot{
+		Name:         request.Name,
+		Repositories: request.Repositories,
+		Actions:      request.Actions,
+	}
+	if request.ExpiresIn > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(request.ExpiresIn) * time.Second)
+		robot.ExpiresAt = &expiresAt
+	}
+
+	token, err := rs.Create(robot)
+	if errors.Is(err, ErrRobotExists) {
+		server.WriteErrorsStatus(w, r, http.StatusConflict, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+	if err != nil {
+		server.WriteErrors(w, r, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+
+	created, _ := rs.robot(ROBOT_PREFIX + robot.Name)
+	created.TokenHash = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateRobotResponse{
+		Robot:    created,
+		Username: ROBOT_PREFIX + robot.Name,
+		Token:    token,
+	})
+}
+
+func (rs *RobotStore) HandleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rs.List())
+}
+
+func (rs *RobotStore) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	err := rs.Revoke(mux.Vars(r)["robot"])
+	if errors.Is(err, ErrRobotUnknown) {
+		server.WriteErrorsStatus(w, r, http.StatusNotFound, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+	if err != nil {
+		server.WriteInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
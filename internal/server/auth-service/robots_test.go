@@ -0,0 +1,216 @@
+package authservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/rs/zerolog"
+)
+
+func TestRobotAuthorization(t *testing.T) {
+	store, err := LoadRobotStore(filepath.Join(t.TempDir(), "robots.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(Robot{Name: "ci", Repositories: []string{"team/**"}, Actions: []string{ACTION_PULL, ACTION_PUSH}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// policy stands in for the authorization of every other caller
+	policy := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Authorized-By", "policy")
+			next.ServeHTTP(w, r)
+		})
+	}
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, server.WithUser(r, r.Header.Get("X-User")))
+		})
+	}
+
+	visible := false
+	router := mux.NewRouter()
+	router.Use(authenticate, store.Authorization(policy))
+	for _, path := range []string{
+		"/v2/",
+		"/v2/tags/list",
+		"/v2/{name:.+}/manifests/{reference}",
+		"/admin/usage",
+		"/admin/{name:.+}/usage",
+	} {
+		router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			visible = server.CanSeeRepository(r, "other/app")
+		})
+	}
+
+	tests := []struct {
+		user     string
+		method   string
+		path     string
+		status   int
+		byPolicy bool
+	}{
+		{"alice", http.MethodDelete, "/v2/other/app/manifests/latest", http.StatusOK, true},
+		{"alice", http.MethodGet, "/admin/usage", http.StatusOK, true},
+		{"robot$ci", http.MethodGet, "/v2/", http.StatusOK, false},
+		{"robot$ci", http.MethodGet, "/v2/tags/list", http.StatusOK, false},
+		{"robot$ci", http.MethodGet, "/v2/team/app/manifests/latest", http.StatusOK, false},
+		{"robot$ci", http.MethodPut, "/v2/team/sub/app/manifests/latest", http.StatusOK, false},
+		{"robot$ci", http.MethodDelete, "/v2/team/app/manifests/latest", http.StatusForbidden, false},
+		{"robot$ci", http.MethodGet, "/v2/other/app/manifests/latest", http.StatusForbidden, false},
+		{"robot$ci", http.MethodGet, "/v2/team/manifests/latest", http.StatusForbidden, false},
+		{"robot$ci", http.MethodGet, "/admin/usage", http.StatusForbidden, false},
+		{"robot$ci", http.MethodGet, "/admin/team/app/usage", http.StatusForbidden, false},
+		{"robot$revoked", http.MethodGet, "/v2/team/app/manifests/latest", http.StatusUnauthorized, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("X-User", test.user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s %s answered %d, want %d", test.user, test.method, test.path, w.Code, test.status)
+		}
+		if byPolicy := w.Header().Get("X-Authorized-By") == "policy"; byPolicy != test.byPolicy {
+			t.Errorf("%s %s %s authorized by policy %t, want %t", test.user, test.method, test.path, byPolicy, test.byPolicy)
+		}
+		if test.path == "/v2/tags/list" && visible {
+			t.Errorf("%s sees repositories it may not pull", test.user)
+		}
+	}
+}
+
+func TestRobotAuthenticate(t *testing.T) {
+	store, err := LoadRobotStore(filepath.Join(t.TempDir(), "robots.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.Create(Robot{Name: "ci", Repositories: []string{"app"}, Actions: []string{ACTION_PULL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Minute)
+	expiredToken, err := store.Create(Robot{Name: "old", Repositories: []string{"app"}, Actions: []string{ACTION_PULL}, ExpiresAt: &expired})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"robot$ci", token, true},
+		{"robot$ci", token + "x", false},
+		{"robot$ci", expiredToken, false},
+		{"ci", token, false},
+		{"robot$old", expiredToken, false},
+		{"robot$unknown", token, false},
+	}
+	for _, test := range tests {
+		if ok := store.Authenticate(test.user, test.password); ok != test.ok {
+			t.Errorf("Authenticate(%q) = %t, want %t", test.user, ok, test.ok)
+		}
+	}
+
+	// the token survives a restart, but not its revocation
+	store.Close()
+	reloaded, err := LoadRobotStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reloaded.Close)
+	if !reloaded.Authenticate("robot$ci", token) {
+		t.Error("token rejected after reloading the store")
+	}
+	if err := reloaded.Revoke("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Authenticate("robot$ci", token) {
+		t.Error("revoked token accepted")
+	}
+}
+
+func TestRobotLastUsed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "robots")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	store, err := LoadRobotStore(filepath.Join(dir, "robots.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.WithLogger(zerolog.New(&logs))
+	token, err := store.Create(Robot{Name: "ci", Repositories: []string{"app"}, Actions: []string{ACTION_PULL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.Authenticate("robot$ci", token) {
+		t.Fatal("token rejected")
+	}
+	store.Close()
+	reloaded, err := LoadRobotStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if robots := reloaded.List(); len(robots) != 1 || robots[0].LastUsedAt == nil {
+		t.Fatalf("saved %+v, want the last use of ci", robots)
+	}
+
+	// a failing save does not fail the authentication but is logged
+	other, err := reloaded.WithLogger(zerolog.New(&logs)).Create(Robot{Name: "other", Repositories: []string{"app"}, Actions: []string{ACTION_PULL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.Authenticate("robot$other", other) {
+		t.Fatal("token rejected while the store cannot be saved")
+	}
+	reloaded.Close()
+	if !strings.Contains(logs.String(), "failed to record robot use") {
+		t.Errorf("logged %q, want the failed save", logs.String())
+	}
+}
+
+func TestCreateRobotValidatesRepositories(t *testing.T) {
+	store, err := LoadRobotStore(filepath.Join(t.TempDir(), "robots.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		repositories []string
+		status       int
+	}{
+		{[]string{"team/**"}, http.StatusCreated},
+		{[]string{"app", "[a-"}, http.StatusBadRequest},
+		{[]string{"team/[/**"}, http.StatusBadRequest},
+	}
+	for i, test := range tests {
+		body, _ := json.Marshal(CreateRobotRequest{Name: fmt.Sprintf("ci-%d", i), Repositories: test.repositories, Actions: []string{ACTION_PULL}})
+		w := httptest.NewRecorder()
+		store.HandleCreate(w, httptest.NewRequest(http.MethodPost, "/admin/robots", bytes.NewReader(body)))
+		if w.Code != test.status {
+			t.Errorf("creating a robot for %v answered %d, want %d", test.repositories, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package authservice
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+const (
+	TOKEN_PATH     = "/token"
+	DEFAULT_EXPIRY = 5 * time.Minute
+)
+
+var ErrUnsupportedKey = errors.New("unsupported signing key")
+
+// Authorizer returns the subset of access.Actions user may perform on the
+// resource of access. An empty user is an anonymous caller.
+type Authorizer func(user string, access Access) []string
+
+// AuthenticatedOnly grants every requested action except admin to
+// authenticated users and nothing to anonymous ones. Admin access has to be
+// granted by a policy.
+func AuthenticatedOnly(user string, access Access) []string {
+	if user == "" || (access.Type == TYPE_REGISTRY && access.Name == ADMIN) {
+		return nil
+	}
+	if access.Type == TYPE_REGISTRY {
+		return access.Actions
+	}
+	return slices.DeleteFunc(slices.Clone(access.Actions), func(action string) bool {
+		return action == ACTION_ADMIN
+	})
+}
+
+type Claims struct {
+	jwt.RegisteredClaims
+	Access []Access `json:"access"`
+}
+
+type TokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// TokenService implements the Docker registry token authentication: it
+// issues signed JWTs on TOKEN_PATH and validates them on every other route.
+type TokenService struct {
+	issuer        string
+	service       string
+	realm         string
+	expiry        time.Duration
+	key           crypto.Signer
+	method        jwt.SigningMethod
+	authenticator Authenticator
+	authorize     Authorizer
+}
+
+// NewTokenService creates a token service signing with key. Credentials
+// presented to the token endpoint are checked by authenticator, which may be
+// nil to only issue anonymous tokens.
+func NewTokenService(issuer, service string, key crypto.Signer, authenticator Authenticator) (*TokenService, error) {
+	method, err := signingMethod(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenService{
+		issuer:        issuer,
+		service:       service,
+		expiry:        DEFAULT_EXPIRY,
+		key:           key,
+		method:        method,
+		authenticator: authenticator,
+		authorize:     AuthenticatedOnly,
+	}, nil
+}
+
+// WithRealm sets the token endpoint URL announced in challenges. By default
+// it is derived from the request.
+func (ts *TokenService) WithRealm(realm string) *TokenService {
+	ts.realm = realm
+	return ts
+}
+
+func (ts *TokenService) WithExpiry(expiry time.Duration) *TokenService {
+	ts.expiry = expiry
+	return ts
+}
+
+func (ts *TokenService) WithAuthorizer(authorize Authorizer) *TokenService {
+	ts.authorize = authorize
+	return ts
+}
+
+func signingMethod(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// LoadSigningKey reads a PEM encoded RSA, ECDSA or Ed25519 private key.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, ErrUnsupportedKey
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: %w", path, ErrUnsupportedKey)
+}
+
+// GenerateSigningKey creates an ephemeral ECDSA key. Tokens signed with it
+// become invalid when the process restarts.
+func GenerateSigningKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// HandleToken issues a token for the scopes requested in the query. Callers
+// already authenticated, e.g. by client certificate, or presenting valid
+// basic credentials get the actions the authorizer grants them, anonymous
+// callers the ones granted to anonymous users.
+func (ts *TokenService) HandleToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := server.UserFromRequest(r)
+	if u, password, ok := r.BasicAuth(); ok && user == "" {
+		if ts.authenticator == nil || !ts.authenticator.Authenticate(u, password) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ts.service))
+			server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+			return
+		}
+		user = u
+	}
+
+	requested, err := ParseScope(strings.Join(r.URL.Query()["scope"], " "))
+	if err != nil {
+		server.WriteErrors(w, r, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+
+	granted := make([]Access, 0, len(requested))
+	for _, access := range requested {
+		if actions := ts.authorize(user, access); len(actions) > 0 {
+			granted = append(granted, Access{Type: access.Type, Name: access.Name, Actions: actions})
+		}
+	}
+
+	now := time.Now()
+	token, err := jwt.NewWithClaims(ts.method, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ts.issuer,
+			Subject:   user,
+			Audience:  jwt.ClaimStrings{ts.service},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ts.expiry)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+		Access: granted,
+	}).SignedString(ts.key)
+	if err != nil {
+		server.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(ts.expiry.Seconds()),
+		IssuedAt:    now.UTC(),
+	})
+}
+
+// Middleware rejects requests without a valid bearer token granting the
+// access the route requires. The token endpoint itself stays reachable.
+func (ts *TokenService) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == TOKEN_PATH {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required, action, needsAccess := RequiredAccess(r)
+
+		raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			ts.challenge(w, r, required, needsAccess, "")
+			return
+		}
+
+		claims := &Claims{}
+		_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (any, error) {
+			return ts.key.Public(), nil
+		},
+			jwt.WithValidMethods([]string{ts.method.Alg()}),
+			jwt.WithIssuer(ts.issuer),
+			jwt.WithAudience(ts.service),
+			jwt.WithExpirationRequired(),
+		)
+		if err != nil {
+			ts.challenge(w, r, required, needsAccess, "invalid_token")
+			return
+		}
+
+		if needsAccess && !slices.ContainsFunc(claims.Access, func(granted Access) bool {
+			return granted.Allows(required, action)
+		}) {
+			ts.challenge(w, r, required, needsAccess, "insufficient_scope")
+			return
+		}
+
+		next.ServeHTTP(w, server.WithUser(r, claims.Subject))
+	})
+}
+
+func (ts *TokenService) challenge(w http.ResponseWriter, r *http.Request, required Access, withScope bool, reason string) {
+	realm := ts.realm
+	if realm == "" {
+		realm = fmt.Sprintf("%s://%s%s", server.GetScheme(r), r.Host, TOKEN_PATH)
+	}
+
+	challenge := fmt.Sprintf("Bearer realm=%q,service=%q", realm, ts.service)
+	if withScope {
+		challenge += fmt.Sprintf(",scope=%q", required.String())
+	}
+	if reason != "" {
+		challenge += fmt.Sprintf(",error=%q", reason)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+	server.WriteErrors(w, r, server.ERROR_UNAUTHORIZED)
+}
@@ -0,0 +1,126 @@
+package authservice
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+func TestTokenMiddleware(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewTokenService("simple-reg", "registry", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signWith := func(signer crypto.Signer, change func(*Claims), access ...Access) string {
+		now := time.Now()
+		claims := Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "simple-reg",
+				Subject:   "alice",
+				Audience:  jwt.ClaimStrings{"registry"},
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(now),
+			},
+			Access: access,
+		}
+		if change != nil {
+			change(&claims)
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	sign := func(change func(*Claims), access ...Access) string {
+		return signWith(key, change, access...)
+	}
+	pull := Access{Type: TYPE_REPOSITORY, Name: "app", Actions: []string{ACTION_PULL}}
+
+	user := ""
+	router := mux.NewRouter()
+	router.Use(ts.Middleware)
+	for _, path := range []string{"/v2/", "/v2/{name:.+}/manifests/{reference}", TOKEN_PATH, "/admin/usage"} {
+		router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			user, _ = server.UserFromRequest(r)
+		})
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+		user   string
+		// scope and reason are the parameters of the challenge of rejected
+		// requests
+		scope  string
+		reason string
+	}{
+		{"token endpoint", http.MethodGet, TOKEN_PATH, "", http.StatusOK, "", "", ""},
+		{"no token", http.MethodGet, "/v2/app/manifests/latest", "", http.StatusUnauthorized, "", "repository:app:pull", ""},
+		{"no token for version check", http.MethodGet, "/v2/", "", http.StatusUnauthorized, "", "", ""},
+		{"version check", http.MethodGet, "/v2/", sign(nil), http.StatusOK, "alice", "", ""},
+		{"granted pull", http.MethodGet, "/v2/app/manifests/latest", sign(nil, pull), http.StatusOK, "alice", "", ""},
+		{"pull token for push", http.MethodPut, "/v2/app/manifests/latest", sign(nil, pull), http.StatusUnauthorized, "", "repository:app:push", "insufficient_scope"},
+		{"pull token for other repository", http.MethodGet, "/v2/other/manifests/latest", sign(nil, pull), http.StatusUnauthorized, "", "repository:other:pull", "insufficient_scope"},
+		{"wildcard grant", http.MethodDelete, "/v2/app/manifests/latest", sign(nil, Access{Type: TYPE_REPOSITORY, Name: "app", Actions: []string{ACTION_ADMIN}}), http.StatusOK, "alice", "", ""},
+		{"repository grant for admin route", http.MethodGet, "/admin/usage", sign(nil, pull), http.StatusUnauthorized, "", "registry:admin:*", "insufficient_scope"},
+		{"admin grant", http.MethodGet, "/admin/usage", sign(nil, Access{Type: TYPE_REGISTRY, Name: ADMIN, Actions: []string{ACTION_ADMIN}}), http.StatusOK, "alice", "", ""},
+		{"malformed token", http.MethodGet, "/v2/app/manifests/latest", "not-a-token", http.StatusUnauthorized, "", "repository:app:pull", "invalid_token"},
+		{"other key", http.MethodGet, "/v2/app/manifests/latest", signWith(otherKey, nil, pull), http.StatusUnauthorized, "", "repository:app:pull", "invalid_token"},
+		{"expired", http.MethodGet, "/v2/app/manifests/latest", sign(func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, pull), http.StatusUnauthorized, "", "repository:app:pull", "invalid_token"},
+		{"no expiry", http.MethodGet, "/v2/app/manifests/latest", sign(func(c *Claims) { c.ExpiresAt = nil }, pull), http.StatusUnauthorized, "", "repository:app:pull", "invalid_token"},
+		{"other issuer", http.MethodGet, "/v2/app/manifests/latest", sign(func(c *Claims) { c.Issuer = "elsewhere" }, pull), http.StatusUnauthorized, "", "repository:app:pull", "invalid_token"},
+		{"other audience", http.MethodGet, "/v2/app/manifests/latest", sign(func(c *Claims) { c.Audience = jwt.ClaimStrings{"other"} }, pull), http.StatusUnauthorized, "", "repository:app:pull", "invalid_token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user = ""
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			challenge := w.Header().Get("WWW-Authenticate")
+			if w.Code != test.status || user != test.user {
+				t.Fatalf("answered %d as %q, want %d as %q", w.Code, user, test.status, test.user)
+			}
+			if w.Code == http.StatusOK {
+				return
+			}
+
+			if !strings.HasPrefix(challenge, `Bearer realm="http://example.com/token",service="registry"`) {
+				t.Errorf("challenge %q does not announce the token endpoint", challenge)
+			}
+			if hasScope := strings.Contains(challenge, "scope="); hasScope != (test.scope != "") ||
+				(test.scope != "" && !strings.Contains(challenge, fmt.Sprintf("scope=%q", test.scope))) {
+				t.Errorf("challenge %q, want scope %q", challenge, test.scope)
+			}
+			if hasReason := strings.Contains(challenge, "error="); hasReason != (test.reason != "") ||
+				(test.reason != "" && !strings.Contains(challenge, fmt.Sprintf("error=%q", test.reason))) {
+				t.Errorf("challenge %q, want error %q", challenge, test.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package blobservice
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// GarbageCollect deletes every blob whose digest is not in referenced
+// together with its links.
+// Blobs younger than gracePeriod are kept, as they may belong to a push
+// whose manifest has not been uploaded yet. Returns the deleted digests.
+func (bs *BlobService) GarbageCollect(referenced map[string]bool, gracePeriod time.Duration) (deleted []string, err error) {
+	bs.blobs.Lock()
+	defer bs.blobs.Unlock()
+
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		gcRuns.WithLabelValues(result).Inc()
+		gcDeletedBlobs.Add(float64(len(deleted)))
+	}()
+
+	files, err := os.ReadDir(BlobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted = make([]string, 0)
+	for _, file := range files {
+		digest := "sha256:" + file.Name()
+		if file.IsDir() || !server.IsValidDigest(digest) || referenced[digest] {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil || time.Since(info.ModTime()) < gracePeriod {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(BlobDir, file.Name())); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, digest)
+		// removed after the blob, a link left behind by a failure only
+		// grants access to the same content again once it is uploaded
+		if err := os.RemoveAll(filepath.Join(BlobDir, linksDir, file.Name())); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
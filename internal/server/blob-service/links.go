@@ -0,0 +1,120 @@
+package blobservice
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// Blobs are stored once for all repositories. Which repositories may read a
+// blob is recorded by empty files in _links/<hex>/<repo>/_link, the file
+// name starts with an underscore so it never clashes with nested
+// repositories. Links are created when a blob is uploaded to a repository or
+// a manifest pushed to it references the blob, and removed together with
+// the blob by garbage collection.
+const (
+	linksDir = "_links"
+	linkFile = "_link"
+)
+
+// linkPath returns the link of the blob digest to repo.
+func linkPath(repo, digest string) (string, bool) {
+	if !server.IsValidName(repo) {
+		return "", false
+	}
+	dir := filepath.Join(BlobDir, linksDir, digest)
+	path := filepath.Join(dir, repo, linkFile)
+	return path, server.IsWithinDir(dir, path)
+}
+
+// link links the blob digest to repo, the caller holds the blobs lock.
+func link(repo, digest string) error {
+	path, ok := linkPath(repo, digest)
+	if !ok {
+		return ErrBlobUnknown
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, nil, 0644)
+}
+
+func isLinked(repo, digest string) (bool, error) {
+	path, ok := linkPath(repo, digest)
+	if !ok {
+		return false, nil
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Link links the stored blob digest to repo for a manifest pushed to repo
+// referencing it. Blobs linked to other repositories only are
+// ErrBlobUnknown, they have to be uploaded to repo, so knowing a digest is
+// not enough to read a blob. Blobs linked to no repository at all were
+// uploaded before links were recorded and are linked.
+func (bs *BlobService) Link(repo, digest string) error {
+	if !server.IsValidDigest("sha256:" + ensureNoShaPrefix(digest)) {
+		return ErrInvalidDigest
+	}
+	digest = ensureNoShaPrefix(digest)
+
+	bs.blobs.Lock()
+	defer bs.blobs.Unlock()
+
+	if _, err := os.Stat(filepath.Join(BlobDir, digest)); errors.Is(err, fs.ErrNotExist) {
+		return ErrBlobUnknown
+	} else if err != nil {
+		return err
+	}
+
+	linked, err := isLinked(repo, digest)
+	if err != nil || linked {
+		return err
+	}
+	links, err := os.ReadDir(filepath.Join(BlobDir, linksDir, digest))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(links) > 0 {
+		return ErrBlobUnknown
+	}
+	return link(repo, digest)
+}
+
+// MigrateLinks links the stored blobs to the repositories whose manifests
+// reference them, for storage written before blobs were linked. referenced
+// returns the referenced digests by repository. Once links exist it does
+// nothing.
+func (bs *BlobService) MigrateLinks(referenced func() (map[string][]string, error)) error {
+	bs.blobs.Lock()
+	defer bs.blobs.Unlock()
+
+	dir := filepath.Join(BlobDir, linksDir)
+	if _, err := os.Stat(dir); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	repos, err := referenced()
+	if err != nil {
+		return err
+	}
+	for repo, digests := range repos {
+		for _, digest := range digests {
+			digest = ensureNoShaPrefix(digest)
+			if _, err := os.Stat(filepath.Join(BlobDir, digest)); errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err := link(repo, digest); err != nil {
+				return err
+			}
+		}
+	}
+	return os.MkdirAll(dir, 0755)
+}
@@ -0,0 +1,61 @@
+package blobservice
+
+import (
+	"os"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	activeUploads = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "upload_sessions",
+		Help:      "Blob upload sessions currently open.",
+	})
+
+	uploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "blob_uploaded_bytes_total",
+		Help:      "Bytes written to blob upload sessions.",
+	})
+
+	gcRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "gc_runs_total",
+		Help:      "Blob garbage collection runs by result.",
+	}, []string{"result"})
+
+	gcDeletedBlobs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "gc_deleted_blobs_total",
+		Help:      "Blobs deleted by garbage collection.",
+	})
+
+	blobsDesc   = prometheus.NewDesc(server.METRICS_NAMESPACE+"_blobs", "Stored blobs.", nil, nil)
+	storageDesc = prometheus.NewDesc(server.METRICS_NAMESPACE+"_blob_storage_bytes", "Bytes used by stored blobs.", nil, nil)
+)
+
+// Describe and Collect count the stored blobs on every scrape. They do not
+// take the lock, which is held while chunks are uploaded.
+func (bs *BlobService) Describe(ch chan<- *prometheus.Desc) {
+	ch <- blobsDesc
+	ch <- storageDesc
+}
+
+func (bs *BlobService) Collect(ch chan<- prometheus.Metric) {
+	blobs, size := 0, int64(0)
+	files, _ := os.ReadDir(BlobDir)
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || file.IsDir() || !server.IsValidDigest("sha256:"+file.Name()) {
+			continue
+		}
+		blobs++
+		size += info.Size()
+	}
+
+	ch <- prometheus.MustNewConstMetric(blobsDesc, prometheus.GaugeValue, float64(blobs))
+	ch <- prometheus.MustNewConstMetric(storageDesc, prometheus.GaugeValue, float64(size))
+}
@@ -1,6 +1,7 @@
 package blobservice
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -9,31 +10,72 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/nilspolek/simple-reg/internal/server"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
+	tracer = otel.Tracer("github.com/nilspolek/simple-reg/internal/server/blob-service")
+
 	BlobDir           = "./data/blobs"
 	ErrUploadNotFound = errors.New("upload not found")
 	ErrDigestMismatch = errors.New("digest mismatch")
+	ErrInvalidDigest  = errors.New("invalid digest")
+	ErrBlobUnknown    = errors.New("blob unknown")
 )
 
 type BlobService struct {
-	UploadSessions map[uuid.UUID]*os.File
+	// UploadSessions holds the open upload sessions. The mutex of the
+	// BlobService guards only the map, every session has a mutex of its own
+	// held while a chunk is written.
+	UploadSessions map[uuid.UUID]*UploadSession
+	notifier       notificationservice.Notifier
+	// blobs serializes storing blobs with garbage collection
+	blobs sync.Mutex
+	sync.Mutex
+}
+
+// UploadSession is an upload in progress.
+type UploadSession struct {
 	sync.Mutex
+	file *os.File
+	// repo is the repository the upload was started in
+	repo string
+	// closed is set once the session is finalized or closed, writers
+	// waiting for the mutex must not touch file anymore
+	closed bool
+	// updated is when the session was started or last written to
+	updated time.Time
 }
 
 func New() *BlobService {
 	return &BlobService{
-		UploadSessions: map[uuid.UUID]*os.File{},
+		UploadSessions: map[uuid.UUID]*UploadSession{},
 		Mutex:          sync.Mutex{},
 	}
 }
 
-func (bs *BlobService) StartUpload(uploadID uuid.UUID) error {
+// WithNotifier sends an event to notifier for every completed upload.
+func (bs *BlobService) WithNotifier(notifier notificationservice.Notifier) *BlobService {
 	bs.Mutex.Lock()
 	defer bs.Mutex.Unlock()
+	bs.notifier = notifier
+	return bs
+}
+
+func (bs *BlobService) StartUpload(ctx context.Context, uploadID uuid.UUID, repo string) (err error) {
+	_, span := tracer.Start(ctx, "BlobService.StartUpload", trace.WithAttributes(
+		attribute.String("upload.id", uploadID.String()),
+		attribute.String("repository", repo),
+	))
+	defer func() { server.EndSpan(span, err) }()
+
 	filePath := filepath.Join(BlobDir, "uploads", uploadID.String())
 	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
 		return err
@@ -42,23 +84,53 @@ func (bs *BlobService) StartUpload(uploadID uuid.UUID) error {
 	if err != nil {
 		return err
 	}
-	bs.UploadSessions[uploadID] = file
+
+	bs.Mutex.Lock()
+	defer bs.Mutex.Unlock()
+	bs.UploadSessions[uploadID] = &UploadSession{file: file, repo: repo, updated: time.Now()}
+	activeUploads.Inc()
 	return nil
 }
 
-func (bs *BlobService) WriteChunk(uploadID uuid.UUID, r io.ReadCloser) (int64, error) {
+// session returns the open upload session uploadID of repo locked, the
+// caller has to unlock it. Sessions of other repositories are not found.
+func (bs *BlobService) session(uploadID uuid.UUID, repo string) (*UploadSession, error) {
 	bs.Mutex.Lock()
-	defer bs.Mutex.Unlock()
-	file, ok := bs.UploadSessions[uploadID]
-	if !ok {
-		return 0, ErrUploadNotFound
+	session, ok := bs.UploadSessions[uploadID]
+	bs.Mutex.Unlock()
+	if !ok || session.repo != repo {
+		return nil, ErrUploadNotFound
 	}
 
-	info, err := file.Stat()
+	session.Lock()
+	if session.closed {
+		session.Unlock()
+		return nil, ErrUploadNotFound
+	}
+	return session, nil
+}
+
+// WriteChunk appends r to the upload session uploadID of repo. Chunks of the
+// same session are written one after another, other sessions are not
+// blocked.
+func (bs *BlobService) WriteChunk(ctx context.Context, uploadID uuid.UUID, repo string, r io.ReadCloser) (end int64, err error) {
+	_, span := tracer.Start(ctx, "BlobService.WriteChunk", trace.WithAttributes(attribute.String("upload.id", uploadID.String())))
+	defer func() { server.EndSpan(span, err) }()
+
+	session, err := bs.session(uploadID, repo)
 	if err != nil {
 		return 0, err
 	}
-	n, err := io.Copy(file, r)
+	defer session.Unlock()
+
+	info, err := session.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(session.file, r)
+	session.updated = time.Now()
+	uploadedBytes.Add(float64(n))
+	span.SetAttributes(attribute.Int64("upload.bytes", n))
 	if err != nil {
 		return 0, err
 	}
@@ -66,45 +138,144 @@ func (bs *BlobService) WriteChunk(uploadID uuid.UUID, r io.ReadCloser) (int64, e
 	return info.Size() + n - 1, nil
 }
 
-func (bs *BlobService) FinalizeUpload(uploadID uuid.UUID, digest string) error {
+// closeSession removes the upload session uploadID of repo, waits for a
+// chunk still being written to it and closes its file.
+func (bs *BlobService) closeSession(uploadID uuid.UUID, repo string) (*UploadSession, error) {
 	bs.Mutex.Lock()
-	defer bs.Mutex.Unlock()
-	file, ok := bs.UploadSessions[uploadID]
-	if !ok {
-		return ErrUploadNotFound
+	session, ok := bs.UploadSessions[uploadID]
+	if !ok || session.repo != repo {
+		bs.Mutex.Unlock()
+		return nil, ErrUploadNotFound
 	}
+	delete(bs.UploadSessions, uploadID)
+	bs.Mutex.Unlock()
 
-	if err := file.Close(); err != nil {
+	session.Lock()
+	defer session.Unlock()
+	session.closed = true
+	activeUploads.Dec()
+	return session, session.file.Close()
+}
+
+// CancelUpload closes the upload session uploadID of repo and deletes what
+// was uploaded so far.
+func (bs *BlobService) CancelUpload(ctx context.Context, uploadID uuid.UUID, repo string) (err error) {
+	_, span := tracer.Start(ctx, "BlobService.CancelUpload", trace.WithAttributes(attribute.String("upload.id", uploadID.String())))
+	defer func() { server.EndSpan(span, err) }()
+
+	session, err := bs.closeSession(uploadID, repo)
+	if err != nil {
 		return err
 	}
-	delete(bs.UploadSessions, uploadID)
+	return os.Remove(session.file.Name())
+}
 
-	filePath := file.Name()
-	file.Close()
+// ExpireUploads cancels every upload session not written to for longer than
+// idle and returns their IDs. Sessions a chunk is being written to are kept.
+func (bs *BlobService) ExpireUploads(idle time.Duration) ([]uuid.UUID, error) {
+	bs.Mutex.Lock()
+	defer bs.Mutex.Unlock()
 
-	digest = ensureNoShaPrefix(digest)
-	hasher := sha256.New()
-	f, err := os.Open(filePath)
+	expired := make([]uuid.UUID, 0)
+	var errs []error
+	for id, session := range bs.UploadSessions {
+		if !session.TryLock() {
+			continue
+		}
+		if time.Since(session.updated) > idle {
+			delete(bs.UploadSessions, id)
+			session.closed = true
+			activeUploads.Dec()
+			expired = append(expired, id)
+			if err := session.file.Close(); err != nil {
+				errs = append(errs, err)
+			}
+			if err := os.Remove(session.file.Name()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		session.Unlock()
+	}
+	return expired, errors.Join(errs...)
+}
+
+// FinalizeUpload stores the upload session uploadID of repo as the blob
+// digest and links it to repo.
+func (bs *BlobService) FinalizeUpload(ctx context.Context, uploadID uuid.UUID, repo, digest string) (err error) {
+	ctx, span := tracer.Start(ctx, "BlobService.FinalizeUpload", trace.WithAttributes(
+		attribute.String("upload.id", uploadID.String()),
+		attribute.String("blob.digest", digest),
+	))
+	defer func() { server.EndSpan(span, err) }()
+
+	session, err := bs.closeSession(uploadID, repo)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	filePath := session.file.Name()
+
+	if !server.IsValidDigest("sha256:" + ensureNoShaPrefix(digest)) {
+		os.Remove(filePath)
+		return ErrInvalidDigest
+	}
 
-	if _, err := io.Copy(hasher, f); err != nil {
+	digest = ensureNoShaPrefix(digest)
+	sum, err := hashFile(ctx, filePath)
+	if err != nil {
 		return err
 	}
-	if hex.EncodeToString(hasher.Sum(nil)) != digest {
+	if sum != digest {
+		// the session is gone, the client has to upload the blob again
+		os.Remove(filePath)
 		return ErrDigestMismatch
 	}
 
-	finalPath := filepath.Join(BlobDir, digest)
-	if err := os.Rename(filePath, finalPath); err != nil {
+	info, err := os.Stat(filePath)
+	if err != nil {
 		return err
 	}
 
+	_, renameSpan := tracer.Start(ctx, "rename")
+	bs.blobs.Lock()
+	err = os.Rename(filePath, filepath.Join(BlobDir, digest))
+	if err == nil {
+		err = link(repo, digest)
+	}
+	bs.blobs.Unlock()
+	server.EndSpan(renameSpan, err)
+	if err != nil {
+		return err
+	}
+
+	if bs.notifier != nil {
+		event := notificationservice.NewEvent(ctx, notificationservice.EVENT_UPLOAD, session.repo)
+		event.Digest = "sha256:" + digest
+		event.Size = info.Size()
+		bs.notifier.Notify(event)
+	}
 	return nil
 }
 
+// hashFile returns the hex encoded SHA-256 of the file at path.
+func hashFile(ctx context.Context, path string) (sum string, err error) {
+	_, span := tracer.Start(ctx, "hash")
+	defer func() { server.EndSpan(span, err) }()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, f)
+	span.SetAttributes(attribute.Int64("blob.size", n))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 func ensureNoShaPrefix(digest string) string {
 	if strings.HasPrefix(digest, "sha256:") {
 		return digest[len("sha256:"):]
@@ -112,13 +283,85 @@ func ensureNoShaPrefix(digest string) string {
 	return digest
 }
 
-func (bs *BlobService) StreamBlob(digest string) (*os.File, error) {
+// StreamBlob opens the blob digest of repo. Blobs not linked to repo are
+// ErrBlobUnknown, even if another repository stores them.
+func (bs *BlobService) StreamBlob(ctx context.Context, repo, digest string) (file *os.File, err error) {
+	_, span := tracer.Start(ctx, "BlobService.StreamBlob", trace.WithAttributes(
+		attribute.String("repository", repo),
+		attribute.String("blob.digest", digest),
+	))
+	defer func() { server.EndSpan(span, err) }()
+
+	if !server.IsValidDigest("sha256:" + ensureNoShaPrefix(digest)) {
+		return nil, ErrInvalidDigest
+	}
+
 	digest = ensureNoShaPrefix(digest)
+	linked, err := isLinked(repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	if !linked {
+		return nil, ErrBlobUnknown
+	}
 	filePath := filepath.Join(BlobDir, digest)
-	file, err := os.Open(filePath)
+	file, err = os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 
 	return file, nil
 }
+
+// UploadSize returns the bytes written to the upload session uploadID of
+// repo so far.
+func (bs *BlobService) UploadSize(uploadID uuid.UUID, repo string) (int64, error) {
+	session, err := bs.session(uploadID, repo)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Unlock()
+
+	info, err := session.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Size returns the size of the stored blob digest.
+func (bs *BlobService) Size(digest string) (int64, error) {
+	if !server.IsValidDigest("sha256:" + ensureNoShaPrefix(digest)) {
+		return 0, ErrInvalidDigest
+	}
+
+	info, err := os.Stat(filepath.Join(BlobDir, ensureNoShaPrefix(digest)))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Close flushes and closes the files of every open upload session. It waits
+// for chunks still being written. The partial uploads stay on disk.
+func (bs *BlobService) Close() error {
+	bs.Mutex.Lock()
+	sessions := bs.UploadSessions
+	bs.UploadSessions = map[uuid.UUID]*UploadSession{}
+	bs.Mutex.Unlock()
+
+	var errs []error
+	for _, session := range sessions {
+		session.Lock()
+		if err := session.file.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := session.file.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		session.closed = true
+		session.Unlock()
+		activeUploads.Dec()
+	}
+	return errors.Join(errs...)
+}
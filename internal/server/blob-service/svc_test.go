@@ -0,0 +1,241 @@
+package blobservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func useTempBlobDir(t *testing.T) {
+	t.Helper()
+	dir := BlobDir
+	BlobDir = t.TempDir()
+	t.Cleanup(func() { BlobDir = dir })
+}
+
+func TestSlowChunkBlocksOnlyItsSession(t *testing.T) {
+	useTempBlobDir(t)
+	bs := New()
+	ctx := context.Background()
+
+	slow := uuid.New()
+	if err := bs.StartUpload(ctx, slow, "app"); err != nil {
+		t.Fatal(err)
+	}
+	body, client := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		_, err := bs.WriteChunk(ctx, slow, "app", body)
+		written <- err
+	}()
+	// the client sends a first byte and stalls
+	if _, err := client.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		other := uuid.New()
+		if err := bs.StartUpload(ctx, other, "app"); err != nil {
+			done <- err
+			return
+		}
+		if _, err := bs.WriteChunk(ctx, other, "app", io.NopCloser(strings.NewReader("layer"))); err != nil {
+			done <- err
+			return
+		}
+		done <- bs.FinalizeUpload(ctx, other, "app", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer"))))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload blocked by a stalled chunk of another session")
+	}
+
+	client.Close()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if size, err := bs.UploadSize(slow, "app"); err != nil || size != 1 {
+		t.Errorf("UploadSize = %d, %v, want 1", size, err)
+	}
+}
+
+func TestFinalizeWaitsForChunk(t *testing.T) {
+	useTempBlobDir(t)
+	bs := New()
+	ctx := context.Background()
+
+	id := uuid.New()
+	if err := bs.StartUpload(ctx, id, "app"); err != nil {
+		t.Fatal(err)
+	}
+	body, client := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		_, err := bs.WriteChunk(ctx, id, "app", body)
+		written <- err
+	}()
+	if _, err := client.Write([]byte("lay")); err != nil {
+		t.Fatal(err)
+	}
+
+	finalized := make(chan error, 1)
+	go func() {
+		finalized <- bs.FinalizeUpload(ctx, id, "app", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer"))))
+	}()
+	// give finalize time to wait for the session
+	time.Sleep(50 * time.Millisecond)
+	if _, err := client.Write([]byte("er")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-finalized; err != nil {
+		t.Fatalf("finalize did not see the whole chunk: %v", err)
+	}
+	if _, err := bs.WriteChunk(ctx, id, "app", io.NopCloser(strings.NewReader("x"))); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("write after finalize returned %v, want %v", err, ErrUploadNotFound)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	useTempBlobDir(t)
+	bs := New()
+	ctx := context.Background()
+
+	store := func(repo, content string) string {
+		t.Helper()
+		id := uuid.New()
+		if err := bs.StartUpload(ctx, id, repo); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bs.WriteChunk(ctx, id, repo, io.NopCloser(strings.NewReader(content))); err != nil {
+			t.Fatal(err)
+		}
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+		if err := bs.FinalizeUpload(ctx, id, repo, digest); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	readable := func(repo, digest string) bool {
+		t.Helper()
+		file, err := bs.StreamBlob(ctx, repo, digest)
+		if errors.Is(err, ErrBlobUnknown) {
+			return false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		return true
+	}
+
+	layer := store("app", "layer")
+	if !readable("app", layer) || readable("other", layer) {
+		t.Fatal("an uploaded blob is readable from its repository only")
+	}
+	if err := bs.Link("other", layer); !errors.Is(err, ErrBlobUnknown) {
+		t.Errorf("linking a blob of another repository returned %v, want %v", err, ErrBlobUnknown)
+	}
+	if err := bs.Link("app", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))); !errors.Is(err, ErrBlobUnknown) {
+		t.Errorf("linking a missing blob returned %v, want %v", err, ErrBlobUnknown)
+	}
+
+	// blobs stored before links were recorded
+	legacy := fmt.Sprintf("%x", sha256.Sum256([]byte("legacy")))
+	orphan := fmt.Sprintf("%x", sha256.Sum256([]byte("orphan")))
+	for _, digest := range []string{legacy, orphan} {
+		if err := os.WriteFile(filepath.Join(BlobDir, digest), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(BlobDir, linksDir)); err != nil {
+		t.Fatal(err)
+	}
+	migrate := func() (map[string][]string, error) {
+		return map[string][]string{"app": {layer, "sha256:" + legacy}}, nil
+	}
+	if err := bs.MigrateLinks(migrate); err != nil {
+		t.Fatal(err)
+	}
+	if !readable("app", layer) || !readable("app", legacy) || readable("app", orphan) {
+		t.Error("migration links the referenced blobs only")
+	}
+	// a blob linked to no repository is linked by the first push
+	if err := bs.Link("other", orphan); err != nil || !readable("other", orphan) {
+		t.Errorf("linking a blob without links returned %v", err)
+	}
+
+	if _, err := bs.GarbageCollect(map[string]bool{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(BlobDir, linksDir, ensureNoShaPrefix(layer))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("garbage collection left the links of %s: %v", layer, err)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	useTempBlobDir(t)
+	bs := New()
+	ctx := context.Background()
+
+	idle, busy := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{idle, busy} {
+		if err := bs.StartUpload(ctx, id, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, client := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		_, err := bs.WriteChunk(ctx, busy, "app", body)
+		written <- err
+	}()
+	if _, err := client.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := bs.ExpireUploads(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != idle {
+		t.Errorf("expired %v, want only %s", expired, idle)
+	}
+	if _, err := os.Stat(filepath.Join(BlobDir, "uploads", idle.String())); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expired upload left its file: %v", err)
+	}
+
+	client.Close()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.CancelUpload(ctx, busy, "other"); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("cancelling through another repository returned %v, want %v", err, ErrUploadNotFound)
+	}
+	if err := bs.CancelUpload(ctx, busy, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.UploadSize(busy, "app"); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("cancelled upload returned %v, want %v", err, ErrUploadNotFound)
+	}
+}
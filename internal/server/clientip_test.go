@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		values   []string
+		networks []string
+		valid    bool
+	}{
+		{[]string{"10.0.0.1"}, []string{"10.0.0.1/32"}, true},
+		{[]string{" 10.0.0.0/8 ", ""}, []string{"10.0.0.0/8"}, true},
+		{[]string{"::1", "fd00::/8"}, []string{"::1/128", "fd00::/8"}, true},
+		{[]string{"192.168.1.7/24"}, []string{"192.168.1.0/24"}, true},
+		{[]string{"proxy.local"}, nil, false},
+		{[]string{"10.0.0.0/33"}, nil, false},
+	}
+	for _, test := range tests {
+		proxies, err := ParseTrustedProxies(test.values...)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseTrustedProxies(%q) returned %v, want valid %t", test.values, err, test.valid)
+			continue
+		}
+		if len(proxies) != len(test.networks) {
+			t.Errorf("ParseTrustedProxies(%q) = %v, want %v", test.values, proxies, test.networks)
+			continue
+		}
+		for i, proxy := range proxies {
+			if proxy.String() != test.networks[i] {
+				t.Errorf("ParseTrustedProxies(%q)[%d] = %s, want %s", test.values, i, proxy, test.networks[i])
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.1", "172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer().WithTrustedProxies(proxies...)
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"spoofed header from untrusted client", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:5000", []string{"198.51.100.1, 172.16.3.4"}, "198.51.100.1"},
+		{"header split across lines", "10.0.0.1:5000", []string{"198.51.100.1", "172.16.3.4"}, "198.51.100.1"},
+		{"spoofed hop before untrusted one", "10.0.0.1:5000", []string{"192.0.2.9, 198.51.100.1"}, "198.51.100.1"},
+		{"invalid hop", "10.0.0.1:5000", []string{"198.51.100.1, unknown"}, "10.0.0.1"},
+		{"remote address without port", "10.0.0.1", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		r.RemoteAddr = test.remote
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := svr.clientIP(r); ip != test.ip {
+			t.Errorf("%s: clientIP = %s, want %s", test.name, ip, test.ip)
+		}
+	}
+}
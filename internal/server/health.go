@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	HEALTH_PATH = "/healthz"
+	READY_PATH  = "/readyz"
+	// HEALTH_CHECK_TIMEOUT bounds the readiness checks of a single probe.
+	HEALTH_CHECK_TIMEOUT = 5 * time.Second
+)
+
+// HealthCheck returns an error when the registry can not serve requests.
+type HealthCheck func(ctx context.Context) error
+
+type healthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// WithHealthCheck adds a check that has to pass for READY_PATH to report the
+// server ready.
+func (s *Server) WithHealthCheck(name string, check HealthCheck) *Server {
+	s.healthChecks = append(s.healthChecks, healthCheck{name: name, check: check})
+	return s
+}
+
+// handler serves the probes in front of the router, so they bypass its
+// middlewares: probes carry no credentials and would only add noise to the
+// request logs and metrics.
+func (s *Server) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r = s.withDeadlines(w, r)
+		switch r.URL.Path {
+		case HEALTH_PATH:
+			handleHealth(w, r)
+		case READY_PATH:
+			s.handleReady(w, r)
+		default:
+			s.Router.ServeHTTP(w, s.withRequestContext(w, r))
+		}
+	})
+}
+
+// handleHealth is the liveness probe, answering proves the process is alive.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	response := ReadinessResponse{Status: "ok", Checks: map[string]string{}}
+	status := http.StatusOK
+	for _, check := range s.healthChecks {
+		if err := check.check(ctx); err != nil {
+			response.Checks[check.name] = err.Error()
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		response.Checks[check.name] = "ok"
+	}
+
+	if status != http.StatusOK {
+		s.log.Warn().Any("checks", response.Checks).Msg("readiness check failed")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+type identityKey struct{}
+
+// requestInfo collects what inner middlewares and handlers learn about a
+// request for the middlewares wrapping them, like the access log.
+type requestInfo struct {
+	user      string
+	clientIP  string
+	requestID string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	return requestInfoFromContext(r.Context())
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// Caller describes who sent a request, for services that only get its
+// context.
+type Caller struct {
+	User      string
+	ClientIP  string
+	RequestID string
+}
+
+// CallerFromContext returns the caller of the request ctx belongs to. All
+// fields are empty outside of requests.
+func CallerFromContext(ctx context.Context) Caller {
+	info := requestInfoFromContext(ctx)
+	return Caller{User: info.user, ClientIP: info.clientIP, RequestID: info.requestID}
+}
+
+// WithUser returns a copy of r carrying the authenticated user.
+func WithUser(r *http.Request, user string) *http.Request {
+	requestInfoFrom(r).user = user
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, user))
+}
+
+// UserFromRequest returns the user authenticated for r, if any.
+func UserFromRequest(r *http.Request) (string, bool) {
+	user, ok := r.Context().Value(identityKey{}).(string)
+	return user, ok && user != ""
+}
+
+type repositoryFilterKey struct{}
+
+// WithRepositoryFilter returns a copy of r that only lets listings show the
+// repositories visible returns true for.
+func WithRepositoryFilter(r *http.Request, visible func(repo string) bool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), repositoryFilterKey{}, visible))
+}
+
+// CanSeeRepository reports whether repo may be shown to the caller of r.
+func CanSeeRepository(r *http.Request, repo string) bool {
+	visible, ok := r.Context().Value(repositoryFilterKey{}).(func(string) bool)
+	return !ok || visible(repo)
+}
@@ -0,0 +1,80 @@
+package manifestservice
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var ErrTagImmutable = errors.New("tag is immutable")
+
+// ImmutableTagRule marks every tag matching Tag inside a repository matching
+// Repository as immutable. Repository is a path.Match glob, so "*" does not
+// cross a "/"; an empty Repository matches every repository.
+type ImmutableTagRule struct {
+	Repository string
+	Tag        *regexp.Regexp
+}
+
+// ParseImmutableTagRule parses a rule of the form "<repository glob>=<tag regexp>",
+// e.g. "library/*=^v[0-9]+\.[0-9]+\.[0-9]+$".
+func ParseImmutableTagRule(rule string) (ImmutableTagRule, error) {
+	repo, tag, ok := strings.Cut(rule, "=")
+	if !ok {
+		return ImmutableTagRule{}, fmt.Errorf("invalid immutable tag rule %q, expected <repository glob>=<tag regexp>", rule)
+	}
+
+	if _, err := path.Match(repo, ""); err != nil {
+		return ImmutableTagRule{}, fmt.Errorf("invalid repository glob %q: %w", repo, err)
+	}
+
+	re, err := regexp.Compile(tag)
+	if err != nil {
+		return ImmutableTagRule{}, fmt.Errorf("invalid tag regexp %q: %w", tag, err)
+	}
+
+	return ImmutableTagRule{Repository: repo, Tag: re}, nil
+}
+
+func (rule ImmutableTagRule) Matches(repo, tag string) bool {
+	if rule.Repository != "" {
+		if ok, _ := path.Match(rule.Repository, repo); !ok {
+			return false
+		}
+	}
+	return rule.Tag.MatchString(tag)
+}
+
+// WithImmutableTags replaces the rules deciding which tags may never move once
+// they have been pushed.
+func (svc *ManifestService) WithImmutableTags(rules ...ImmutableTagRule) *ManifestService {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.immutable = rules
+	return svc
+}
+
+func (svc *ManifestService) isImmutable(repo, tag string) bool {
+	for _, rule := range svc.immutable {
+		if rule.Matches(repo, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMove returns ErrTagImmutable if moving tag inside dir to digest is
+// forbidden. Pointing an immutable tag at the digest it already has is allowed.
+func (svc *ManifestService) checkMove(repo, dir, tag, digest string) error {
+	if !svc.isImmutable(repo, tag) {
+		return nil
+	}
+
+	current, err := resolve(dir, tag)
+	if errors.Is(err, ErrManifestUnknown) || (err == nil && current == digest) {
+		return nil
+	}
+	return ErrTagImmutable
+}
@@ -0,0 +1,66 @@
+package manifestservice
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	manifestsPushed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "manifests_pushed_total",
+		Help:      "Manifests pushed.",
+	})
+
+	manifestsDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "manifests_deleted_total",
+		Help:      "Manifests and tags deleted through the API.",
+	})
+
+	repositoriesDesc = prometheus.NewDesc(server.METRICS_NAMESPACE+"_repositories", "Repositories holding manifests or tags.", nil, nil)
+	manifestsDesc    = prometheus.NewDesc(server.METRICS_NAMESPACE+"_manifests", "Stored manifests.", nil, nil)
+	tagsDesc         = prometheus.NewDesc(server.METRICS_NAMESPACE+"_tags", "Tags across all repositories.", nil, nil)
+	storageDesc      = prometheus.NewDesc(server.METRICS_NAMESPACE+"_manifest_storage_bytes", "Bytes used by stored manifests.", nil, nil)
+)
+
+// Describe and Collect count the stored manifests on every scrape.
+func (svc *ManifestService) Describe(ch chan<- *prometheus.Desc) {
+	ch <- repositoriesDesc
+	ch <- manifestsDesc
+	ch <- tagsDesc
+	ch <- storageDesc
+}
+
+func (svc *ManifestService) Collect(ch chan<- prometheus.Metric) {
+	svc.RLock()
+	defer svc.RUnlock()
+
+	repos := repositories()
+	manifests, tags, size := 0, 0, int64(0)
+	for _, dir := range repos {
+		tags += len(readTags(dir))
+
+		files, err := os.ReadDir(filepath.Join(dir, digestsDir))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil || file.IsDir() || !server.IsValidDigest("sha256:"+file.Name()) {
+				continue
+			}
+			manifests++
+			size += info.Size()
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(repositoriesDesc, prometheus.GaugeValue, float64(len(repos)))
+	ch <- prometheus.MustNewConstMetric(manifestsDesc, prometheus.GaugeValue, float64(manifests))
+	ch <- prometheus.MustNewConstMetric(tagsDesc, prometheus.GaugeValue, float64(tags))
+	ch <- prometheus.MustNewConstMetric(storageDesc, prometheus.GaugeValue, float64(size))
+}
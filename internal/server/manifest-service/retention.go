@@ -0,0 +1,333 @@
+package manifestservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+)
+
+// RetentionPolicy decides which tags of the repositories matching Repository
+// are kept. A tag is kept if any of the configured conditions applies to it,
+// all other tags expire. Repository is a path.Match glob, an empty Repository
+// matches every repository. Immutable tags never expire.
+type RetentionPolicy struct {
+	Repository    string
+	KeepLast      int
+	KeepNewerThan time.Duration
+	KeepTags      *regexp.Regexp
+}
+
+// RETENTION_ACTOR is the actor of the delete events of expired tags.
+const RETENTION_ACTOR = "retention"
+
+type ExpiredTag struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+}
+
+// ParseRetentionPolicy parses a policy of the form
+// "<repository glob>=last:<n>,days:<n>,match:<tag regexp>". Every condition
+// is optional, but match has to come last as the regexp may contain commas.
+func ParseRetentionPolicy(policy string) (RetentionPolicy, error) {
+	repo, conditions, ok := strings.Cut(policy, "=")
+	if !ok {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention policy %q, expected <repository glob>=<conditions>", policy)
+	}
+
+	if _, err := path.Match(repo, ""); err != nil {
+		return RetentionPolicy{}, fmt.Errorf("invalid repository glob %q: %w", repo, err)
+	}
+
+	result := RetentionPolicy{Repository: repo}
+	for conditions != "" {
+		key, value, ok := strings.Cut(conditions, ":")
+		if !ok {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention condition %q", conditions)
+		}
+
+		if key == "match" {
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return RetentionPolicy{}, fmt.Errorf("invalid tag regexp %q: %w", value, err)
+			}
+			result.KeepTags = re
+			break
+		}
+
+		value, conditions, _ = strings.Cut(value, ",")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid value %q for %s", value, key)
+		}
+
+		switch key {
+		case "last":
+			result.KeepLast = n
+		case "days":
+			result.KeepNewerThan = time.Duration(n) * 24 * time.Hour
+		default:
+			return RetentionPolicy{}, fmt.Errorf("unknown retention condition %q", key)
+		}
+	}
+
+	return result, nil
+}
+
+func (policy RetentionPolicy) Matches(repo string) bool {
+	if policy.Repository == "" {
+		return true
+	}
+	ok, _ := path.Match(policy.Repository, repo)
+	return ok
+}
+
+func (policy RetentionPolicy) isEmpty() bool {
+	return policy.KeepLast == 0 && policy.KeepNewerThan == 0 && policy.KeepTags == nil
+}
+
+type taggedDigest struct {
+	tag      string
+	digest   string
+	pushedAt time.Time
+}
+
+// ApplyRetention deletes every tag expired under the first policy matching
+// its repository. Manifests left without tag and not referenced by another
+// manifest of the repository are deleted as well, so their blobs can be
+// garbage collected. Returns the expired tags.
+func (svc *ManifestService) ApplyRetention(ctx context.Context, now time.Time, policies ...RetentionPolicy) ([]ExpiredTag, error) {
+	events := make([]notificationservice.Event, 0)
+	svc.Lock()
+	defer svc.unlockAndNotify(ctx, &events)
+
+	expired := make([]ExpiredTag, 0)
+	for repo, dir := range repositories() {
+		index := -1
+		for i, policy := range policies {
+			if policy.Matches(repo) {
+				index = i
+				break
+			}
+		}
+		if index < 0 || policies[index].isEmpty() {
+			continue
+		}
+		policy := policies[index]
+
+		tags := make([]taggedDigest, 0)
+		for _, tag := range readTags(dir) {
+			digest, err := resolve(dir, tag)
+			if err != nil {
+				continue
+			}
+			tags = append(tags, taggedDigest{tag: tag, digest: digest, pushedAt: pushedAt(dir, tag)})
+		}
+
+		// newest first, so KeepLast keeps the head of the slice
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i].pushedAt.After(tags[j].pushedAt)
+		})
+
+		orphans := make(map[string]bool)
+		for i, tag := range tags {
+			switch {
+			case i < policy.KeepLast,
+				policy.KeepNewerThan > 0 && now.Sub(tag.pushedAt) < policy.KeepNewerThan,
+				policy.KeepTags != nil && policy.KeepTags.MatchString(tag.tag),
+				svc.isImmutable(repo, tag.tag):
+				continue
+			}
+
+			if err := os.Remove(tagPath(dir, tag.tag)); err != nil {
+				return expired, err
+			}
+			orphans[tag.digest] = true
+			expired = append(expired, ExpiredTag{Repository: repo, Tag: tag.tag, Digest: tag.digest})
+
+			event := notificationservice.NewEvent(ctx, notificationservice.EVENT_DELETE, repo)
+			event.Tag = tag.tag
+			event.Digest = tag.digest
+			event.Actor = RETENTION_ACTOR
+			events = append(events, event)
+		}
+
+		removed, err := removeOrphans(dir, orphans)
+		for _, digest := range removed {
+			svc.removed(repo, digest)
+		}
+		if err != nil {
+			return expired, err
+		}
+	}
+
+	return expired, nil
+}
+
+// pushedAt returns when tag was last moved, falling back to the modification
+// time of the tag file for tags without history.
+func pushedAt(dir, tag string) time.Time {
+	history, err := readHistory(dir, tag)
+	if err == nil && len(history) > 0 {
+		return history[len(history)-1].Timestamp
+	}
+
+	info, err := os.Stat(tagPath(dir, tag))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// removeOrphans deletes the manifests in candidates that are neither tagged
+// nor referenced by another manifest of the repository dir. Returns the
+// deleted digests.
+func removeOrphans(dir string, candidates map[string]bool) ([]string, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	for _, tag := range readTags(dir) {
+		if digest, err := resolve(dir, tag); err == nil {
+			delete(candidates, digest)
+		}
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, digestsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, digestsDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		for _, digest := range References(data) {
+			delete(candidates, digest)
+		}
+	}
+
+	removed := make([]string, 0, len(candidates))
+	for digest := range candidates {
+		err := os.Remove(digestPath(dir, digest))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, digest)
+	}
+	return removed, nil
+}
+
+type descriptor struct {
+	Digest string `json:"digest"`
+}
+
+type manifestReferences struct {
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+	Subject   *descriptor  `json:"subject"`
+}
+
+// References returns every digest the manifest data points at.
+func References(data []byte) []string {
+	var refs manifestReferences
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil
+	}
+
+	digests := make([]string, 0, len(refs.Layers)+len(refs.Manifests)+2)
+	for _, desc := range append(append(refs.Layers, refs.Manifests...), derefAll(refs.Config, refs.Subject)...) {
+		if server.IsValidDigest(desc.Digest) {
+			digests = append(digests, desc.Digest)
+		}
+	}
+	return digests
+}
+
+// blobReferences returns the digest of the config and every layer of the
+// manifest data, the references stored as blobs rather than manifests.
+func blobReferences(data []byte) []string {
+	var refs manifestReferences
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil
+	}
+
+	digests := make([]string, 0, len(refs.Layers)+1)
+	for _, desc := range append(refs.Layers, derefAll(refs.Config)...) {
+		if server.IsValidDigest(desc.Digest) {
+			digests = append(digests, desc.Digest)
+		}
+	}
+	return digests
+}
+
+func derefAll(descs ...*descriptor) []descriptor {
+	result := make([]descriptor, 0, len(descs))
+	for _, desc := range descs {
+		if desc != nil {
+			result = append(result, *desc)
+		}
+	}
+	return result
+}
+
+// CollectGarbage passes the digest of every blob referenced by a stored
+// manifest of any repository to sweep, which deletes the others. No
+// manifest is pushed until sweep returns, so a push cannot reference a blob
+// while it is deleted.
+func (svc *ManifestService) CollectGarbage(sweep func(referenced map[string]bool) error) error {
+	svc.Lock()
+	defer svc.Unlock()
+
+	referenced, err := referencedBlobs()
+	if err != nil {
+		return err
+	}
+	return sweep(referenced)
+}
+
+// referencedBlobs returns the digest of every blob referenced by a stored
+// manifest of any repository.
+func referencedBlobs() (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, dir := range repositories() {
+		files, err := os.ReadDir(filepath.Join(dir, digestsDir))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if !server.IsValidDigest("sha256:" + file.Name()) {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, digestsDir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, digest := range References(data) {
+				referenced[digest] = true
+			}
+		}
+	}
+	return referenced, nil
+}
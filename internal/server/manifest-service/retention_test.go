@@ -0,0 +1,262 @@
+package manifestservice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   RetentionPolicy
+		tags   string
+		valid  bool
+	}{
+		{"app=last:3", RetentionPolicy{Repository: "app", KeepLast: 3}, "", true},
+		{"team/*=days:7", RetentionPolicy{Repository: "team/*", KeepNewerThan: 7 * 24 * time.Hour}, "", true},
+		{"*=last:2,days:1,match:^v[0-9]+,[0-9]+$", RetentionPolicy{Repository: "*", KeepLast: 2, KeepNewerThan: 24 * time.Hour}, "^v[0-9]+,[0-9]+$", true},
+		{"=match:^release-", RetentionPolicy{}, "^release-", true},
+		{"app=", RetentionPolicy{Repository: "app"}, "", true},
+		{"app", RetentionPolicy{}, "", false},
+		{"[=last:1", RetentionPolicy{}, "", false},
+		{"app=last", RetentionPolicy{}, "", false},
+		{"app=last:-1", RetentionPolicy{}, "", false},
+		{"app=last:x", RetentionPolicy{}, "", false},
+		{"app=weeks:2", RetentionPolicy{}, "", false},
+		{"app=match:(", RetentionPolicy{}, "", false},
+	}
+	for _, test := range tests {
+		policy, err := ParseRetentionPolicy(test.policy)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseRetentionPolicy(%q) returned %v, want valid %t", test.policy, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+
+		tags := ""
+		if policy.KeepTags != nil {
+			tags = policy.KeepTags.String()
+		}
+		policy.KeepTags = nil
+		if policy != test.want || tags != test.tags {
+			t.Errorf("ParseRetentionPolicy(%q) = %+v with tags %q, want %+v with tags %q", test.policy, policy, tags, test.want, test.tags)
+		}
+	}
+}
+
+type agedTag struct {
+	repo string
+	tag  string
+	age  time.Duration
+}
+
+// pushAged pushes a manifest of its own for tag and backdates it by age.
+func pushAged(t *testing.T, svc *ManifestService, now time.Time, tag agedTag) {
+	t.Helper()
+	data := fmt.Appendf(nil, `{"schemaVersion":2,"annotations":{"tag":%q}}`, tag.tag)
+	if _, err := svc.CreateManifest(context.Background(), data, tag.repo, tag.tag, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	backdate(t, now, tag)
+}
+
+// backdate replaces the history of tag with a single move age before now.
+func backdate(t *testing.T, now time.Time, tag agedTag) {
+	t.Helper()
+	dir := filepath.Join(ManifestDir, tag.repo)
+	if err := os.Remove(historyPath(dir, tag.tag)); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := resolve(dir, tag.tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendHistory(dir, tag.tag, TagHistoryEntry{Digest: digest, Timestamp: now.Add(-tag.age), Pusher: "tester"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	const day = 24 * time.Hour
+	tags := []agedTag{
+		{"app", "v1", 30 * day},
+		{"app", "v2", 10 * day},
+		{"app", "v3", 2 * day},
+		{"app", "latest", time.Hour},
+		{"app", "release-1", 40 * day},
+		{"team/tool", "old", 20 * day},
+		{"team/tool", "new", day},
+	}
+
+	tests := []struct {
+		name      string
+		policies  []RetentionPolicy
+		immutable []ImmutableTagRule
+		expired   []string
+	}{
+		{
+			name: "no policy",
+		},
+		{
+			name:     "keep last",
+			policies: []RetentionPolicy{{Repository: "app", KeepLast: 2}},
+			expired:  []string{"app:release-1", "app:v1", "app:v2"},
+		},
+		{
+			name:     "keep newer than",
+			policies: []RetentionPolicy{{KeepNewerThan: 7 * day}},
+			expired:  []string{"app:release-1", "app:v1", "app:v2", "team/tool:old"},
+		},
+		{
+			name:     "keep matching tags",
+			policies: []RetentionPolicy{{Repository: "app", KeepLast: 1, KeepTags: regexp.MustCompile("^release-")}},
+			expired:  []string{"app:v1", "app:v2", "app:v3"},
+		},
+		{
+			name: "first matching policy wins",
+			policies: []RetentionPolicy{
+				{Repository: "team/*", KeepLast: 1},
+				{KeepNewerThan: 15 * day},
+			},
+			expired: []string{"app:release-1", "app:v1", "team/tool:old"},
+		},
+		{
+			name:     "glob does not cross a slash",
+			policies: []RetentionPolicy{{Repository: "*", KeepLast: 1}},
+			expired:  []string{"app:release-1", "app:v1", "app:v2", "app:v3"},
+		},
+		{
+			name:     "empty policy keeps everything",
+			policies: []RetentionPolicy{{Repository: "app"}, {KeepLast: 1}},
+			expired:  []string{"team/tool:old"},
+		},
+		{
+			name:      "immutable tags never expire",
+			policies:  []RetentionPolicy{{Repository: "app", KeepLast: 1}},
+			immutable: []ImmutableTagRule{{Repository: "app", Tag: regexp.MustCompile("^v[0-9]+$")}},
+			expired:   []string{"app:release-1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempManifestDir(t)
+			svc := New()
+			now := time.Now()
+			for _, tag := range tags {
+				pushAged(t, svc, now, tag)
+			}
+			svc.WithImmutableTags(test.immutable...)
+
+			result, err := svc.ApplyRetention(context.Background(), now, test.policies...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired := make([]string, 0, len(result))
+			for _, tag := range result {
+				expired = append(expired, tag.Repository+":"+tag.Tag)
+			}
+			slices.Sort(expired)
+			if !slices.Equal(expired, test.expired) {
+				t.Fatalf("expired %v, want %v", expired, test.expired)
+			}
+
+			for _, tag := range result {
+				dir := filepath.Join(ManifestDir, tag.Repository)
+				if _, err := resolve(dir, tag.Tag); err == nil {
+					t.Errorf("expired tag %s:%s still resolves", tag.Repository, tag.Tag)
+				}
+				if _, err := os.Stat(digestPath(dir, tag.Digest)); !os.IsNotExist(err) {
+					t.Errorf("manifest %s of expired tag %s:%s was kept", tag.Digest, tag.Repository, tag.Tag)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRetentionKeepsReferencedManifests(t *testing.T) {
+	useTempManifestDir(t)
+	svc := New()
+	ctx := context.Background()
+	now := time.Now()
+
+	image := []byte(`{"schemaVersion":2,"layers":[]}`)
+	digest, err := svc.CreateManifest(ctx, image, "app", "old", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.CreateManifest(ctx, image, "app", "shared", "tester"); err != nil {
+		t.Fatal(err)
+	}
+	backdate(t, now, agedTag{"app", "old", 10 * 24 * time.Hour})
+	backdate(t, now, agedTag{"app", "shared", 24 * time.Hour})
+
+	index := fmt.Appendf(nil, `{"schemaVersion":2,"manifests":[{"digest":%q}]}`, digest)
+	if _, err := svc.CreateManifest(ctx, index, "app", "index", "tester"); err != nil {
+		t.Fatal(err)
+	}
+
+	// old and shared expire, the image is still referenced by the index
+	expired, err := svc.ApplyRetention(ctx, now, RetentionPolicy{KeepLast: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("expired %v, want old and shared", expired)
+	}
+	if _, err := os.Stat(digestPath(filepath.Join(ManifestDir, "app"), digest)); err != nil {
+		t.Errorf("manifest referenced by an index was removed: %v", err)
+	}
+}
+
+func TestCollectGarbageBlocksPushes(t *testing.T) {
+	useTempManifestDir(t)
+	svc := New()
+	ctx := context.Background()
+
+	layer := "sha256:" + strings.Repeat("0f", 32)
+	image := fmt.Appendf(nil, `{"schemaVersion":2,"layers":[{"digest":%q}]}`, layer)
+	if _, err := svc.CreateManifest(ctx, image, "app", "v1", "tester"); err != nil {
+		t.Fatal(err)
+	}
+
+	sweeping, release := make(chan map[string]bool), make(chan struct{})
+	collected := make(chan error, 1)
+	go func() {
+		collected <- svc.CollectGarbage(func(referenced map[string]bool) error {
+			sweeping <- referenced
+			<-release
+			return nil
+		})
+	}()
+	if referenced := <-sweeping; !referenced[layer] {
+		t.Errorf("referenced %v, want %s", referenced, layer)
+	}
+
+	pushed := make(chan error, 1)
+	go func() {
+		_, err := svc.CreateManifest(ctx, []byte(`{"schemaVersion":2,"layers":[]}`), "app", "v2", "tester")
+		pushed <- err
+	}()
+	select {
+	case err := <-pushed:
+		t.Fatalf("push finished during the sweep: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-collected; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+}
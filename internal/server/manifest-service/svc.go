@@ -1,85 +1,549 @@
 package manifestservice
 
 import (
+	"bufio"
+	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer = otel.Tracer("github.com/nilspolek/simple-reg/internal/server/manifest-service")
+
+	ManifestDir        = "data/manifests"
+	ErrInvalidName     = errors.New("invalid repository name")
+	ErrNameUnknown     = errors.New("repository unknown")
+	ErrInvalidRef      = errors.New("invalid reference")
+	ErrManifestUnknown = errors.New("manifest unknown")
+	ErrDigestMismatch  = errors.New("digest mismatch")
+	ErrNoPreviousTag   = errors.New("tag has no previous digest")
+	ErrBlobUnknown     = errors.New("manifest references an unknown blob")
 )
 
-var ManifestDir = "data/manifests"
+// Manifests are stored by digest in <repo>/_digests/<hex> and tags are
+// pointer files in <repo>/_tags/<tag> holding the digest they refer to.
+// Every move of a tag is appended to <repo>/_history/<tag> as JSON lines.
+// All directory names start with an underscore, which the repository name
+// grammar does not allow, so they never clash with nested repositories.
+const (
+	digestsDir = "_digests"
+	tagsDir    = "_tags"
+	historyDir = "_history"
+)
+
+type TagHistoryEntry struct {
+	Digest    string    `json:"digest"`
+	Timestamp time.Time `json:"timestamp"`
+	Pusher    string    `json:"pusher"`
+}
 
 type ManifestService struct {
-	tags map[string][]string
+	sync.RWMutex
+	immutable  []ImmutableTagRule
+	notifier   notificationservice.Notifier
+	recorder   Recorder
+	accountant Accountant
+	blobs      Blobs
 }
 
 func New() *ManifestService {
 	return &ManifestService{}
 }
 
-func (svc *ManifestService) CreateManifest(data []byte, repo, ref string) (string, error) {
-	if err := os.MkdirAll(filepath.Join(ManifestDir, repo), 0755); err != nil {
+// WithNotifier sends an event to notifier for every manifest pushed or
+// deleted and every tag moved.
+func (svc *ManifestService) WithNotifier(notifier notificationservice.Notifier) *ManifestService {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.notifier = notifier
+	return svc
+}
+
+// Recorder is told about every change, e.g. to keep an audit log. It is
+// called while the ManifestService lock is still held, so it sees the
+// changes in the order they happened but delays every other change.
+type Recorder interface {
+	Record(ctx context.Context, event notificationservice.Event)
+}
+
+// WithRecorder passes the event of every manifest pushed or deleted and
+// every tag moved to recorder.
+func (svc *ManifestService) WithRecorder(recorder Recorder) *ManifestService {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.recorder = recorder
+	return svc
+}
+
+// Blobs links the blobs a pushed manifest references to the repository it
+// is pushed to. It is called while the ManifestService lock is held and
+// fails with ErrBlobUnknown for blobs the repository may not read.
+type Blobs interface {
+	Link(repo, digest string) error
+}
+
+// WithBlobs refuses manifests referencing blobs that blobs does not link to
+// their repository.
+func (svc *ManifestService) WithBlobs(blobs Blobs) *ManifestService {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.blobs = blobs
+	return svc
+}
+
+// unlockAndNotify records events, releases the write lock and only then
+// sends events, so a slow notifier does not hold up other requests.
+func (svc *ManifestService) unlockAndNotify(ctx context.Context, events *[]notificationservice.Event) {
+	if svc.recorder != nil {
+		for _, event := range *events {
+			svc.recorder.Record(ctx, event)
+		}
+	}
+	notifier := svc.notifier
+	svc.Unlock()
+
+	if notifier == nil {
+		return
+	}
+	for _, event := range *events {
+		notifier.Notify(event)
+	}
+}
+
+// tagMoved returns event describing tag in repo moving from previous to
+// digest.
+func tagMoved(event notificationservice.Event, tag, digest, previous string) notificationservice.Event {
+	event.Tag = tag
+	event.Digest = digest
+	event.Previous = previous
+	return event
+}
+
+// repoDir resolves the directory of repo and makes sure the result cannot
+// escape ManifestDir.
+func repoDir(repo string) (string, error) {
+	if !server.IsValidName(repo) {
+		return "", ErrInvalidName
+	}
+
+	dir := filepath.Join(ManifestDir, repo)
+	if !server.IsWithinDir(ManifestDir, dir) {
+		return "", ErrInvalidName
+	}
+	return dir, nil
+}
+
+// existingRepoDir is repoDir for reads, it fails with ErrNameUnknown when
+// nothing was ever pushed to repo.
+func existingRepoDir(repo string) (string, error) {
+	dir, err := repoDir(repo)
+	if err != nil {
 		return "", err
 	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNameUnknown
+	} else if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func digestPath(dir, digest string) string {
+	return filepath.Join(dir, digestsDir, ensureNoShaPrefix(digest))
+}
+
+func tagPath(dir, tag string) string {
+	return filepath.Join(dir, tagsDir, tag)
+}
 
-	manifestPath := filepath.Join(ManifestDir, repo, ref)
-	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+func historyPath(dir, tag string) string {
+	return filepath.Join(dir, historyDir, tag)
+}
+
+// CreateManifest stores data under its digest and, if ref is a tag, points
+// the tag at that digest on behalf of pusher. Returns the digest of the
+// manifest.
+func (svc *ManifestService) CreateManifest(ctx context.Context, data []byte, repo, ref, pusher string) (digest string, err error) {
+	ctx, span := tracer.Start(ctx, "ManifestService.CreateManifest", trace.WithAttributes(
+		attribute.String("repository", repo),
+		attribute.String("reference", ref),
+		attribute.Int("manifest.size", len(data)),
+	))
+	defer func() { server.EndSpan(span, err) }()
+
+	events := make([]notificationservice.Event, 0, 2)
+	svc.Lock()
+	defer svc.unlockAndNotify(ctx, &events)
+
+	dir, err := repoDir(repo)
+	if err != nil {
 		return "", err
 	}
+	if !server.IsValidReference(ref) {
+		return "", ErrInvalidRef
+	}
+
+	digest = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if server.IsValidDigest(ref) && ref != digest {
+		return "", ErrDigestMismatch
+	}
+
+	if server.IsValidTag(ref) {
+		if err := svc.checkMove(repo, dir, ref, digest); err != nil {
+			return "", err
+		}
+	}
+
+	if svc.blobs != nil {
+		for _, blob := range blobReferences(data) {
+			if err := svc.blobs.Link(repo, blob); err != nil {
+				return "", err
+			}
+		}
+	}
 
-	svc.tags[repo] = append(svc.tags[repo], ref)
+	_, statErr := os.Stat(digestPath(dir, digest))
+	isNew := errors.Is(statErr, fs.ErrNotExist)
+	if isNew && svc.accountant != nil {
+		if err := svc.accountant.StoreManifest(repo, digest, storedManifest(data)); err != nil {
+			return "", err
+		}
+	}
 
-	file, err := os.Open(manifestPath)
+	_, writeSpan := tracer.Start(ctx, "write")
+	err = server.WriteFileAtomic(digestPath(dir, digest), data)
+	server.EndSpan(writeSpan, err)
 	if err != nil {
+		if isNew {
+			svc.removed(repo, digest)
+		}
 		return "", err
 	}
+
+	previous, moved := "", false
+	if server.IsValidTag(ref) {
+		if previous, moved, err = moveTag(dir, ref, digest, pusher); err != nil {
+			return "", err
+		}
+	}
+
+	manifestsPushed.Inc()
+	event := notificationservice.NewEvent(ctx, notificationservice.EVENT_PUSH, repo)
+	event.Digest = digest
+	event.Size = int64(len(data))
+	if server.IsValidTag(ref) {
+		event.Tag = ref
+	}
+	events = append(events, event)
+	if moved {
+		events = append(events, tagMoved(notificationservice.NewEvent(ctx, notificationservice.EVENT_TAG, repo), ref, digest, previous))
+	}
+	return digest, nil
+}
+
+// moveTag points tag at digest and records the move in the tag history.
+// Pushing the digest a tag already points at is not recorded again. Returns
+// the digest the tag pointed at before and whether it moved.
+func moveTag(dir, tag, digest, pusher string) (previous string, moved bool, err error) {
+	current, err := resolve(dir, tag)
+	if err == nil && current == digest {
+		return current, false, nil
+	}
+
+	if err := server.WriteFileAtomic(tagPath(dir, tag), []byte(digest)); err != nil {
+		return "", false, err
+	}
+
+	return current, true, appendHistory(dir, tag, TagHistoryEntry{
+		Digest:    digest,
+		Timestamp: time.Now().UTC(),
+		Pusher:    pusher,
+	})
+}
+
+func appendHistory(dir, tag string, entry TagHistoryEntry) error {
+	if err := os.MkdirAll(filepath.Join(dir, historyDir), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(historyPath(dir, tag), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
-	haser := sha256.New()
-	if _, err := io.Copy(haser, file); err != nil {
+	return json.NewEncoder(file).Encode(entry)
+}
+
+func readHistory(dir, tag string) ([]TagHistoryEntry, error) {
+	history := make([]TagHistoryEntry, 0)
+	file, err := os.Open(historyPath(dir, tag))
+	if errors.Is(err, fs.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry TagHistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		history = append(history, entry)
+	}
+	return history, scanner.Err()
+}
+
+// GetTagHistory returns every digest tag pointed at, oldest first. Tags
+// that neither exist nor ever existed are ErrManifestUnknown.
+func (svc *ManifestService) GetTagHistory(repo, tag string) ([]TagHistoryEntry, error) {
+	svc.RLock()
+	defer svc.RUnlock()
+
+	dir, err := existingRepoDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	if !server.IsValidTag(tag) {
+		return nil, ErrInvalidRef
+	}
+
+	history, err := readHistory(dir, tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		if _, err := resolve(dir, tag); err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// RollbackTag points tag back at digest on behalf of pusher. When digest is
+// empty the tag is reverted to the most recent digest it pointed at before
+// the current one. Returns the digest the tag now points at.
+func (svc *ManifestService) RollbackTag(ctx context.Context, repo, tag, digest, pusher string) (string, error) {
+	events := make([]notificationservice.Event, 0, 1)
+	svc.Lock()
+	defer svc.unlockAndNotify(ctx, &events)
+
+	dir, err := repoDir(repo)
+	if err != nil {
+		return "", err
+	}
+	if !server.IsValidTag(tag) {
+		return "", ErrInvalidRef
+	}
+
+	if digest == "" {
+		history, err := readHistory(dir, tag)
+		if err != nil {
+			return "", err
+		}
+
+		current, _ := resolve(dir, tag)
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Digest != current {
+				digest = history[i].Digest
+				break
+			}
+		}
+		if digest == "" {
+			return "", ErrNoPreviousTag
+		}
+	}
+
+	if !server.IsValidDigest(digest) {
+		return "", ErrInvalidRef
+	}
+	if _, err := os.Stat(digestPath(dir, digest)); err != nil {
+		return "", ErrManifestUnknown
+	}
+	if err := svc.checkMove(repo, dir, tag, digest); err != nil {
 		return "", err
 	}
 
-	digest := fmt.Sprintf("sha256:%x", haser.Sum(nil))
-	os.WriteFile(path.Join(ManifestDir, repo, digest[len("sha256:"):]), data, 0644)
+	previous, moved, err := moveTag(dir, tag, digest, pusher)
+	if err != nil {
+		return "", err
+	}
+	if moved {
+		events = append(events, tagMoved(notificationservice.NewEvent(ctx, notificationservice.EVENT_TAG, repo), tag, digest, previous))
+	}
 	return digest, nil
 }
 
-func (svc *ManifestService) GetManifest(repo, ref string) ([]byte, string, error) {
-	ref = ensureNoShaPrefix(ref)
-	manifestPath := filepath.Join(ManifestDir, repo, ref)
-	data, err := os.ReadFile(manifestPath)
+func (svc *ManifestService) GetManifest(ctx context.Context, repo, ref string) (data []byte, digest string, err error) {
+	ctx, span := tracer.Start(ctx, "ManifestService.GetManifest", trace.WithAttributes(
+		attribute.String("repository", repo),
+		attribute.String("reference", ref),
+	))
+	defer func() { server.EndSpan(span, err) }()
+
+	svc.RLock()
+	defer svc.RUnlock()
+
+	dir, err := existingRepoDir(repo)
 	if err != nil {
 		return nil, "", err
 	}
 
-	hasher := sha256.New()
-	if _, err := hasher.Write(data); err != nil {
+	digest, err = resolve(dir, ref)
+	if err != nil {
 		return nil, "", err
 	}
 
-	return data, fmt.Sprintf("sha256:%x", hasher.Sum(nil)), nil
+	_, readSpan := tracer.Start(ctx, "read")
+	data, err = os.ReadFile(digestPath(dir, digest))
+	readSpan.End()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", ErrManifestUnknown
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, digest, nil
 }
 
-func (svc *ManifestService) DeleteManifest(repo, ref string) error {
-	ref = ensureNoShaPrefix(ref)
-	manifestPath := filepath.Join(ManifestDir, repo, ref)
-	if err := os.Remove(manifestPath); err != nil {
-		return err
+// DeleteManifest removes a tag when ref is a tag. When ref is a digest the
+// manifest itself is removed together with every tag pointing at it. It
+// returns the digest of the manifest, which is empty for a dangling tag.
+func (svc *ManifestService) DeleteManifest(ctx context.Context, repo, ref string) (digest string, err error) {
+	ctx, span := tracer.Start(ctx, "ManifestService.DeleteManifest", trace.WithAttributes(
+		attribute.String("repository", repo),
+		attribute.String("reference", ref),
+	))
+	defer func() { server.EndSpan(span, err) }()
+
+	events := make([]notificationservice.Event, 0, 1)
+	svc.Lock()
+	defer svc.unlockAndNotify(ctx, &events)
+
+	dir, err := existingRepoDir(repo)
+	if err != nil {
+		return "", err
 	}
-	tags := svc.tags[repo]
 
-	// remove tag from tags
-	for index, tag := range tags {
-		if tag == ref {
-			tags = append(tags[:index], tags[index+1:]...)
-			break
+	if server.IsValidTag(ref) {
+		if svc.isImmutable(repo, ref) {
+			return "", ErrTagImmutable
 		}
+
+		digest, _ = resolve(dir, ref)
+		err := os.Remove(tagPath(dir, ref))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", ErrManifestUnknown
+		}
+		if err != nil {
+			return "", err
+		}
+		manifestsDeleted.Inc()
+
+		event := notificationservice.NewEvent(ctx, notificationservice.EVENT_DELETE, repo)
+		event.Tag = ref
+		event.Digest = digest
+		events = append(events, event)
+		return digest, nil
 	}
-	return nil
+
+	if !server.IsValidDigest(ref) {
+		return "", ErrInvalidRef
+	}
+
+	for _, tag := range readTags(dir) {
+		if digest, err := resolve(dir, tag); err == nil && digest == ref && svc.isImmutable(repo, tag) {
+			return "", ErrTagImmutable
+		}
+	}
+
+	err = os.Remove(digestPath(dir, ref))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrManifestUnknown
+	}
+	if err != nil {
+		return "", err
+	}
+	svc.removed(repo, ref)
+
+	for _, tag := range readTags(dir) {
+		if digest, err := resolve(dir, tag); err == nil && digest == ref {
+			if err := os.Remove(tagPath(dir, tag)); err != nil {
+				return "", err
+			}
+		}
+	}
+	manifestsDeleted.Inc()
+
+	event := notificationservice.NewEvent(ctx, notificationservice.EVENT_DELETE, repo)
+	event.Digest = ref
+	events = append(events, event)
+	return ref, nil
+}
+
+// resolve returns the digest ref refers to inside the repository dir.
+func resolve(dir, ref string) (string, error) {
+	if server.IsValidDigest(ref) {
+		return ref, nil
+	}
+	if !server.IsValidTag(ref) {
+		return "", ErrInvalidRef
+	}
+
+	data, err := os.ReadFile(tagPath(dir, ref))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrManifestUnknown
+	}
+	if err != nil {
+		return "", err
+	}
+
+	digest := strings.TrimSpace(string(data))
+	if !server.IsValidDigest(digest) {
+		return "", ErrManifestUnknown
+	}
+	return digest, nil
+}
+
+// Media types of manifests not declaring one.
+const (
+	MEDIA_TYPE_OCI_MANIFEST = "application/vnd.oci.image.manifest.v1+json"
+	MEDIA_TYPE_OCI_INDEX    = "application/vnd.oci.image.index.v1+json"
+)
+
+// MediaType returns the media type the manifest data declares. Manifests
+// without one are OCI manifests, or OCI indexes when they list manifests.
+func MediaType(data []byte) string {
+	var manifest struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	json.Unmarshal(data, &manifest)
+	if manifest.MediaType != "" {
+		return manifest.MediaType
+	}
+	if manifest.Manifests != nil {
+		return MEDIA_TYPE_OCI_INDEX
+	}
+	return MEDIA_TYPE_OCI_MANIFEST
 }
 
 func ensureNoShaPrefix(digest string) string {
@@ -89,55 +553,118 @@ func ensureNoShaPrefix(digest string) string {
 	return digest
 }
 
-func (svc *ManifestService) GetAllTags() map[string][]string {
-	if len(svc.tags) == 0 {
-		svc.tags = loadTags()
+func (svc *ManifestService) GetAllTags(ctx context.Context) map[string][]string {
+	_, span := tracer.Start(ctx, "ManifestService.GetAllTags")
+	defer span.End()
+
+	svc.RLock()
+	defer svc.RUnlock()
+
+	tags := make(map[string][]string)
+	for repo, dir := range repositories() {
+		tags[repo] = readTags(dir)
 	}
+	return tags
+}
 
-	return svc.tags
+// repositories maps the name of every repository holding manifests or tags
+// to its directory.
+func repositories() map[string]string {
+	repos := make(map[string]string)
+	filepath.WalkDir(ManifestDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case digestsDir, tagsDir, historyDir:
+			repo, err := filepath.Rel(ManifestDir, filepath.Dir(path))
+			if err == nil {
+				repos[filepath.ToSlash(repo)] = filepath.Dir(path)
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return repos
 }
 
-func (svc *ManifestService) GetTags(repo string) []string {
-	if len(svc.tags) == 0 {
-		svc.tags = loadTags()
-	}
+func (svc *ManifestService) GetTags(ctx context.Context, repo string) []string {
+	_, span := tracer.Start(ctx, "ManifestService.GetTags", trace.WithAttributes(attribute.String("repository", repo)))
+	defer span.End()
 
-	if _, ok := svc.tags[repo]; !ok {
-		svc.tags[repo] = []string{}
-	}
+	svc.RLock()
+	defer svc.RUnlock()
 
-	return svc.tags[repo]
+	dir, err := repoDir(repo)
+	if err != nil {
+		return []string{}
+	}
+	return readTags(dir)
 }
 
-func loadTags() map[string][]string {
-	tags := make(map[string][]string)
-	files, err := os.ReadDir(ManifestDir)
+func readTags(dir string) []string {
+	tags := make([]string, 0)
+	files, err := os.ReadDir(filepath.Join(dir, tagsDir))
 	if err != nil {
 		return tags
 	}
 
-	// get each directory in ManifestDir
-	folderNames := make([]string, 0)
 	for _, file := range files {
-		if file.IsDir() {
-			folderNames = append(folderNames, file.Name())
+		if file.IsDir() || !server.IsValidTag(file.Name()) {
+			// skip leftovers of interrupted atomic writes
+			continue
 		}
+		tags = append(tags, file.Name())
 	}
+	return tags
+}
+
+// MigrateLegacyLayout moves manifests written by the old flat layout, where
+// tags and digests shared one directory per repository, into the digest and
+// tag directories.
+func (svc *ManifestService) MigrateLegacyLayout() error {
+	svc.Lock()
+	defer svc.Unlock()
 
-	// get each tag in each directory
-	for _, dir := range folderNames {
-		files, err := os.ReadDir(filepath.Join(ManifestDir, dir))
+	legacy := make([]string, 0)
+	err := filepath.WalkDir(ManifestDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			continue
+			return err
 		}
-		for _, file := range files {
-			if len(file.Name()) == 64 {
-				// tag is a sha
-				continue
+		if d.IsDir() {
+			if d.Name() == digestsDir || d.Name() == tagsDir || d.Name() == historyDir {
+				return filepath.SkipDir
 			}
-			tags[dir] = append(tags[dir], file.Name())
+			return nil
 		}
+		if filepath.Dir(path) != filepath.Clean(ManifestDir) {
+			legacy = append(legacy, path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
 
-	return tags
+	for _, path := range legacy {
+		dir, name := filepath.Dir(path), filepath.Base(path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		if err := server.WriteFileAtomic(digestPath(dir, digest), data); err != nil {
+			return err
+		}
+		if name != ensureNoShaPrefix(digest) && server.IsValidTag(name) {
+			if _, _, err := moveTag(dir, name, digest, "migration"); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,153 @@
+package manifestservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+)
+
+func useTempManifestDir(t *testing.T) {
+	t.Helper()
+	dir := ManifestDir
+	ManifestDir = t.TempDir()
+	t.Cleanup(func() { ManifestDir = dir })
+}
+
+// reentrantNotifier reads from the service while handling an event, which
+// deadlocks if the event is sent under the write lock.
+type reentrantNotifier struct {
+	svc    *ManifestService
+	events chan string
+}
+
+func (n *reentrantNotifier) Notify(event notificationservice.Event) {
+	n.svc.GetTags(context.Background(), event.Repository)
+	n.events <- event.Action
+}
+
+func TestNotifyAfterUnlock(t *testing.T) {
+	useTempManifestDir(t)
+	svc := New()
+	notifier := &reentrantNotifier{svc: svc, events: make(chan string, 16)}
+	svc.WithNotifier(notifier)
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		digest, err := svc.CreateManifest(ctx, []byte(`{"schemaVersion":2}`), "app", "v1", "tester")
+		if err == nil {
+			_, err = svc.CreateManifest(ctx, []byte(`{"schemaVersion":2,"layers":[]}`), "app", "v1", "tester")
+		}
+		if err == nil {
+			_, err = svc.RollbackTag(ctx, "app", "v1", digest, "tester")
+		}
+		if err == nil {
+			_, err = svc.DeleteManifest(ctx, "app", "v1")
+		}
+		if err == nil {
+			_, err = svc.ApplyRetention(ctx, time.Now())
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifier called with the lock held")
+	}
+
+	want := []string{
+		notificationservice.EVENT_PUSH, notificationservice.EVENT_TAG,
+		notificationservice.EVENT_PUSH, notificationservice.EVENT_TAG,
+		notificationservice.EVENT_TAG,
+		notificationservice.EVENT_DELETE,
+	}
+	for _, action := range want {
+		if got := <-notifier.events; got != action {
+			t.Fatalf("got %s event, want %s", got, action)
+		}
+	}
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	useTempManifestDir(t)
+	svc := New()
+
+	image := `{"schemaVersion":2,"layers":[]}`
+	untagged := `{"schemaVersion":2,"config":{}}`
+	tests := []struct {
+		file string
+		data string
+		// repo and tag the file should be migrated to, tag is empty for
+		// manifests stored under their digest
+		repo string
+		tag  string
+	}{
+		{"app/latest", image, "app", "latest"},
+		{"app/v1", image, "app", "v1"},
+		{fmt.Sprintf("app/%x", sha256.Sum256([]byte(untagged))), untagged, "app", ""},
+		{"team/tool/v2", untagged, "team/tool", "v2"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(ManifestDir, test.file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// repositories already migrated and files outside repositories are left alone
+	migrated, err := svc.CreateManifest(context.Background(), []byte(image), "done", "v1", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ManifestDir, "README"), []byte("manifests"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// migrating twice is harmless
+	for range 2 {
+		if err := svc.MigrateLegacyLayout(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range tests {
+		if _, err := os.Stat(filepath.Join(ManifestDir, test.file)); !os.IsNotExist(err) {
+			t.Errorf("%s: legacy file was not removed", test.file)
+		}
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(test.data)))
+		data, _, err := svc.GetManifest(context.Background(), test.repo, digest)
+		if err != nil || string(data) != test.data {
+			t.Errorf("%s: manifest %s = %q, %v, want %q", test.file, digest, data, err, test.data)
+		}
+		if test.tag == "" {
+			continue
+		}
+		if _, resolved, err := svc.GetManifest(context.Background(), test.repo, test.tag); err != nil || resolved != digest {
+			t.Errorf("%s: tag %s:%s resolves to %s, %v, want %s", test.file, test.repo, test.tag, resolved, err, digest)
+		}
+		if history, err := svc.GetTagHistory(test.repo, test.tag); err != nil || len(history) != 1 {
+			t.Errorf("%s: tag history %v, %v, want the migration", test.file, history, err)
+		}
+	}
+	if tags := svc.GetTags(context.Background(), "app"); len(tags) != 2 {
+		t.Errorf("app has tags %v, want latest and v1", tags)
+	}
+	if _, resolved, err := svc.GetManifest(context.Background(), "done", "v1"); err != nil || resolved != migrated {
+		t.Errorf("migrated repository changed: %s, %v", resolved, err)
+	}
+	if _, err := os.Stat(filepath.Join(ManifestDir, "README")); err != nil {
+		t.Errorf("file outside repositories was touched: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package manifestservice
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// StoredManifest is the size of a stored manifest and the distinct digests
+// it references.
+type StoredManifest struct {
+	Size       int64
+	References []string
+}
+
+// RepositoryContents is what a repository stores: its manifests by digest.
+type RepositoryContents struct {
+	Manifests map[string]StoredManifest
+}
+
+// Accountant is told about every manifest stored in or removed from a
+// repository. It is called while the ManifestService lock is held, so it
+// sees the changes in the order they happen and may refuse a manifest, e.g.
+// for exceeding a quota, before it is stored.
+type Accountant interface {
+	StoreManifest(repo, digest string, manifest StoredManifest) error
+	RemoveManifest(repo, digest string)
+}
+
+func (svc *ManifestService) WithAccountant(accountant Accountant) *ManifestService {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.accountant = accountant
+	return svc
+}
+
+func (svc *ManifestService) removed(repo, digest string) {
+	if svc.accountant != nil {
+		svc.accountant.RemoveManifest(repo, digest)
+	}
+}
+
+// storedManifest describes data as stored.
+func storedManifest(data []byte) StoredManifest {
+	manifest := StoredManifest{Size: int64(len(data)), References: make([]string, 0)}
+	for _, digest := range References(data) {
+		if !slices.Contains(manifest.References, digest) {
+			manifest.References = append(manifest.References, digest)
+		}
+	}
+	return manifest
+}
+
+// Contents returns the contents of every repository include returns true
+// for.
+func (svc *ManifestService) Contents(include func(repo string) bool) (map[string]RepositoryContents, error) {
+	svc.RLock()
+	defer svc.RUnlock()
+
+	contents := make(map[string]RepositoryContents)
+	for repo, dir := range repositories() {
+		if !include(repo) {
+			continue
+		}
+
+		repoContents := RepositoryContents{Manifests: make(map[string]StoredManifest)}
+		files, err := os.ReadDir(filepath.Join(dir, digestsDir))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, file := range files {
+			digest := "sha256:" + file.Name()
+			if file.IsDir() || !server.IsValidDigest(digest) {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, digestsDir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			repoContents.Manifests[digest] = storedManifest(data)
+		}
+		contents[repo] = repoContents
+	}
+	return contents, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// METRICS_NAMESPACE prefixes every metric of the registry.
+	METRICS_NAMESPACE = "simple_reg"
+	METRICS_PATH      = "/metrics"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Handled requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	// blob uploads and downloads can take minutes, so the buckets reach
+	// well beyond the usual API latencies
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Request latencies by route and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"route", "method"})
+
+	receivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: "http",
+		Name:      "received_bytes_total",
+		Help:      "Request body bytes read by route.",
+	}, []string{"route"})
+
+	sentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: "http",
+		Name:      "sent_bytes_total",
+		Help:      "Response body bytes written by route.",
+	}, []string{"route"})
+)
+
+// WithMetrics instruments every route and serves the metrics on METRICS_PATH
+// of a separate listener on addr, so scrapers neither pass the registry's
+// authentication nor show up in its metrics.
+func (s *Server) WithMetrics(addr string) *Server {
+	s.metricsAddr = addr
+	s.WithMiddleware(metricsMiddleware)
+	return s
+}
+
+func (s *Server) metricsServer() *http.Server {
+	router := http.NewServeMux()
+	router.Handle(METRICS_PATH, promhttp.Handler())
+	return &http.Server{Addr: s.metricsAddr, Handler: router, ReadHeaderTimeout: s.timeouts.ReadHeader}
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		next.ServeHTTP(rw, r)
+
+		requestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rw.statusCode)).Inc()
+		requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		receivedBytes.WithLabelValues(route).Add(float64(body.read))
+		sentBytes.WithLabelValues(route).Add(float64(rw.written))
+	})
+}
@@ -0,0 +1,107 @@
+package notificationservice
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+const (
+	// EVENT_PUSH is sent when a manifest is pushed.
+	EVENT_PUSH = "push"
+	// EVENT_DELETE is sent when a manifest or tag is deleted, through the
+	// API or by a retention policy.
+	EVENT_DELETE = "delete"
+	// EVENT_TAG is sent when a tag is created or moved to another digest.
+	EVENT_TAG = "tag"
+	// EVENT_UPLOAD is sent when a blob upload completed.
+	EVENT_UPLOAD = "upload"
+	// EVENT_PULL is sent when a manifest is fetched.
+	EVENT_PULL = "pull"
+)
+
+var ACTIONS = []string{EVENT_PUSH, EVENT_DELETE, EVENT_TAG, EVENT_UPLOAD, EVENT_PULL}
+
+// Event describes something that happened to a repository.
+type Event struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	// Previous is the digest a moved tag pointed at before.
+	Previous string `json:"previous,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// Actor is the authenticated user, Address the client IP.
+	Actor     string `json:"actor,omitempty"`
+	Address   string `json:"address,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewEvent returns an event of action on repo caused by the request ctx
+// belongs to.
+func NewEvent(ctx context.Context, action, repo string) Event {
+	caller := server.CallerFromContext(ctx)
+	return Event{
+		ID:         uuid.NewString(),
+		Timestamp:  time.Now().UTC(),
+		Action:     action,
+		Repository: repo,
+		Actor:      caller.User,
+		Address:    caller.ClientIP,
+		RequestID:  caller.RequestID,
+	}
+}
+
+// Filter selects events by repository and action. Repositories are globs as
+// in the access policy, empty Repositories or Actions match every event.
+type Filter struct {
+	Repositories []string `yaml:"repositories"`
+	Actions      []string `yaml:"actions"`
+}
+
+func (f Filter) Validate() error {
+	for _, action := range f.Actions {
+		if !slices.Contains(ACTIONS, action) {
+			return fmt.Errorf("unknown action %q, expected one of %s", action, strings.Join(ACTIONS, ", "))
+		}
+	}
+	for _, pattern := range f.Repositories {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("invalid repository glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (f Filter) Matches(event Event) bool {
+	if len(f.Actions) > 0 && !slices.Contains(f.Actions, event.Action) {
+		return false
+	}
+	return len(f.Repositories) == 0 || slices.ContainsFunc(f.Repositories, func(pattern string) bool {
+		return server.MatchRepository(pattern, event.Repository)
+	})
+}
+
+// Notifier receives events. Notify is called on the request path after the
+// emitting service released its lock, so it should still not block on the
+// network.
+type Notifier interface {
+	Notify(event Event)
+}
+
+// Notifiers passes every event on to each of its notifiers.
+type Notifiers []Notifier
+
+func (n Notifiers) Notify(event Event) {
+	for _, notifier := range n {
+		notifier.Notify(event)
+	}
+}
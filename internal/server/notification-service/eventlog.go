@@ -0,0 +1,135 @@
+package notificationservice
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DEFAULT_EVENT_LOG_SIZE = 1000
+
+// ErrEventsDropped is returned by Since when events after the requested
+// sequence number are no longer retained.
+var ErrEventsDropped = errors.New("events dropped from the event log")
+
+// LoggedEvent is an event at its position Seq in an EventLog.
+type LoggedEvent struct {
+	Seq int64 `json:"seq"`
+	Event
+}
+
+// EventLog keeps the latest events in memory for clients following them.
+// Sequence numbers start at the current time in nanoseconds, so they keep
+// growing across restarts and clients resuming from before one are told
+// that they missed events.
+type EventLog struct {
+	mu      sync.Mutex
+	events  []LoggedEvent
+	size    int
+	lastSeq int64
+	// dropped is the sequence number up to which events are not retained,
+	// either dropped for space or sent before the log was created
+	dropped int64
+	changed chan struct{}
+	closed  bool
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{
+		size:    size,
+		dropped: time.Now().UnixNano(),
+		changed: make(chan struct{}),
+	}
+}
+
+// WithSize sets how many events are retained, dropping the oldest ones.
+func (l *EventLog) WithSize(size int) *EventLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.size = size
+	l.trim()
+	return l
+}
+
+func (l *EventLog) Notify(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastSeq = max(l.lastSeq+1, time.Now().UnixNano())
+	l.events = append(l.events, LoggedEvent{Seq: l.lastSeq, Event: event})
+	l.trim()
+
+	if !l.closed {
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+}
+
+func (l *EventLog) trim() {
+	if len(l.events) > l.size {
+		l.dropped = max(l.dropped, l.events[len(l.events)-l.size-1].Seq)
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+// Since returns the retained events after seq that match filter, oldest
+// first, and the sequence number of the latest event looked at, which is
+// where to continue from. A nil filter matches every event, seq 0 asks for
+// every retained event.
+//
+// When events after seq are no longer retained it returns ErrEventsDropped
+// and the sequence number to continue from with the retained events.
+func (l *EventLog) Since(seq int64, filter func(Event) bool) ([]LoggedEvent, int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq > 0 && seq < l.dropped {
+		return nil, l.dropped, ErrEventsDropped
+	}
+
+	start := sort.Search(len(l.events), func(i int) bool {
+		return l.events[i].Seq > seq
+	})
+
+	events := []LoggedEvent{}
+	for _, event := range l.events[start:] {
+		if filter == nil || filter(event.Event) {
+			events = append(events, event)
+		}
+	}
+	return events, max(seq, l.lastSeq), nil
+}
+
+// Last returns the sequence number of the latest event.
+func (l *EventLog) Last() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSeq
+}
+
+// Changed returns a channel that is closed by the next event or by Close.
+// Take it before calling Since to not miss an event in between.
+func (l *EventLog) Changed() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changed
+}
+
+// Closed reports whether Close was called.
+func (l *EventLog) Closed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Close wakes every client waiting for events for good, so streams end
+// instead of holding up the shutdown.
+func (l *EventLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.changed)
+	}
+}
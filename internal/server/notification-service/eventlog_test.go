@@ -0,0 +1,58 @@
+package notificationservice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEventLogSince(t *testing.T) {
+	log := NewEventLog(3)
+	seqs := make([]int64, 0)
+	for _, repo := range []string{"a", "b", "c", "d", "e"} {
+		log.Notify(Event{Action: EVENT_PUSH, Repository: repo})
+		seqs = append(seqs, log.Last())
+	}
+	all, last, err := log.Since(0, nil)
+	if err != nil || len(all) != 3 || all[0].Repository != "c" || last != log.Last() {
+		t.Fatalf("Since(0) = %v, %d, %v, want c, d and e", all, last, err)
+	}
+
+	tests := []struct {
+		name    string
+		seq     int64
+		repos   []string
+		dropped bool
+	}{
+		{"from the start", 0, []string{"c", "d", "e"}, false},
+		{"from the oldest retained", all[0].Seq, []string{"d", "e"}, false},
+		{"from the latest", all[2].Seq, nil, false},
+		{"from a dropped event", seqs[0], nil, true},
+		{"from the last dropped event", seqs[1], []string{"c", "d", "e"}, false},
+		{"from before the log existed", 1, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, next, err := log.Since(test.seq, nil)
+			if test.dropped {
+				if !errors.Is(err, ErrEventsDropped) {
+					t.Fatalf("err = %v, want %v", err, ErrEventsDropped)
+				}
+				// continuing from next returns every retained event
+				if events, _, err := log.Since(next, nil); err != nil || len(events) != 3 {
+					t.Errorf("continuing from %d returned %d events, %v", next, len(events), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			repos := make([]string, 0, len(events))
+			for _, event := range events {
+				repos = append(repos, event.Repository)
+			}
+			if len(repos) != len(test.repos) || (len(repos) > 0 && repos[0] != test.repos[0]) {
+				t.Errorf("returned %v, want %v", repos, test.repos)
+			}
+		})
+	}
+}
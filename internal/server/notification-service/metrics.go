@@ -0,0 +1,21 @@
+package notificationservice
+
+import (
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhookQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "webhook_events_queued_total",
+		Help:      "Events queued for delivery by webhook endpoint.",
+	}, []string{"endpoint"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: server.METRICS_NAMESPACE,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts by endpoint and result: success, failure or dropped after the last attempt.",
+	}, []string{"endpoint", "result"})
+)
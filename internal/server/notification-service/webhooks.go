@@ -0,0 +1,393 @@
+package notificationservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SIGNATURE_HEADER = "X-Simple-Reg-Signature"
+	EVENT_HEADER     = "X-Simple-Reg-Event"
+	DELIVERY_HEADER  = "X-Simple-Reg-Delivery"
+
+	DEFAULT_TIMEOUT      = 10 * time.Second
+	DEFAULT_MAX_ATTEMPTS = 10
+	// MAX_BACKOFF caps the exponential backoff between attempts.
+	MAX_BACKOFF = 5 * time.Minute
+
+	// failedDir keeps the deliveries of an endpoint that ran out of attempts.
+	failedDir = "failed"
+)
+
+var endpointNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// WebhookConfig lists the endpoints events are posted to.
+//
+//	endpoints:
+//	  - name: deploy
+//	    url: https://ci.example.com/hooks/registry
+//	    secret: s3cr3t
+//	    repositories: ["prod/**"]
+//	    actions: [push, tag]
+type WebhookConfig struct {
+	Endpoints []Endpoint `yaml:"endpoints"`
+}
+
+// Endpoint receives the events matching its filter as JSON POST requests.
+// With a Secret set, the body is signed with HMAC-SHA256 in the
+// SIGNATURE_HEADER.
+type Endpoint struct {
+	Name        string `yaml:"name"`
+	URL         string `yaml:"url"`
+	Secret      string `yaml:"secret"`
+	Filter      `yaml:",inline"`
+	Headers     map[string]string `yaml:"headers"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	MaxAttempts int               `yaml:"max-attempts"`
+}
+
+func LoadWebhookConfig(path string) (*WebhookConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &WebhookConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c *WebhookConfig) Validate() error {
+	names := make(map[string]bool)
+	for i, endpoint := range c.Endpoints {
+		if !endpointNameRegexp.MatchString(endpoint.Name) {
+			return fmt.Errorf("endpoint %d: invalid name %q, use letters, digits, - and _", i+1, endpoint.Name)
+		}
+		if names[endpoint.Name] {
+			return fmt.Errorf("endpoint %d: duplicate name %q", i+1, endpoint.Name)
+		}
+		names[endpoint.Name] = true
+
+		if u, err := url.Parse(endpoint.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint %s: %q is not an http or https URL", endpoint.Name, endpoint.URL)
+		}
+		if err := endpoint.Filter.Validate(); err != nil {
+			return fmt.Errorf("endpoint %s: %w", endpoint.Name, err)
+		}
+		if endpoint.Timeout < 0 || endpoint.MaxAttempts < 0 {
+			return fmt.Errorf("endpoint %s: timeout and max-attempts must not be negative", endpoint.Name)
+		}
+	}
+	return nil
+}
+
+// delivery is an event queued for an endpoint.
+type delivery struct {
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// queue holds the deliveries of one endpoint as files in dir, named so
+// they sort in the order the events happened. They are delivered in that
+// order, a failing delivery holds back the ones after it.
+type queue struct {
+	Endpoint
+	dir  string
+	wake chan struct{}
+}
+
+// Webhooks posts events to the configured endpoints. Events are queued on
+// disk before Notify returns, so they survive restarts and are retried with
+// exponential backoff until the endpoint accepts them.
+type Webhooks struct {
+	queues []*queue
+	client *http.Client
+	log    zerolog.Logger
+
+	mu      sync.Mutex
+	lastSeq int64
+
+	// stop ends the delivery loops, cancelling ctx aborts running deliveries
+	stop   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWebhooks queues events for the endpoints of config below dir.
+func NewWebhooks(config *WebhookConfig, dir string, logger zerolog.Logger) (*Webhooks, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wh := &Webhooks{
+		client: &http.Client{},
+		log:    logger,
+		stop:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for _, endpoint := range config.Endpoints {
+		if endpoint.Timeout == 0 {
+			endpoint.Timeout = DEFAULT_TIMEOUT
+		}
+		if endpoint.MaxAttempts == 0 {
+			endpoint.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+		}
+
+		q := &queue{
+			Endpoint: endpoint,
+			dir:      filepath.Join(dir, endpoint.Name),
+			wake:     make(chan struct{}, 1),
+		}
+		if err := os.MkdirAll(filepath.Join(q.dir, failedDir), 0700); err != nil {
+			cancel()
+			return nil, err
+		}
+		wh.queues = append(wh.queues, q)
+	}
+	return wh, nil
+}
+
+// Start delivers queued events in the background until Close is called,
+// including the ones left over from the last run.
+func (wh *Webhooks) Start() *Webhooks {
+	for _, q := range wh.queues {
+		wh.wg.Add(1)
+		go wh.run(q)
+	}
+	return wh
+}
+
+// Close stops delivering and waits for running deliveries until ctx is done.
+// Undelivered events stay queued for the next start.
+func (wh *Webhooks) Close(ctx context.Context) error {
+	close(wh.stop)
+	defer wh.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wh.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Notify queues event for every endpoint it matches.
+func (wh *Webhooks) Notify(event Event) {
+	data := []byte(nil)
+	for _, q := range wh.queues {
+		if !q.Matches(event) {
+			continue
+		}
+
+		if data == nil {
+			var err error
+			data, err = json.Marshal(delivery{Event: event})
+			if err != nil {
+				wh.log.Error().Err(err).Msg("failed to encode webhook event")
+				return
+			}
+		}
+
+		name := fmt.Sprintf("%020d-%s.json", wh.nextSeq(), event.ID)
+		if err := server.WriteFileAtomic(filepath.Join(q.dir, name), data); err != nil {
+			wh.log.Error().Err(err).Str("endpoint", q.Name).Str("event", event.ID).Msg("failed to queue webhook event")
+			continue
+		}
+		webhookQueued.WithLabelValues(q.Name).Inc()
+
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextSeq returns a strictly increasing number based on the current time,
+// so queue files sort by the time events happened.
+func (wh *Webhooks) nextSeq() int64 {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	wh.lastSeq = max(wh.lastSeq+1, time.Now().UnixNano())
+	return wh.lastSeq
+}
+
+func (wh *Webhooks) run(q *queue) {
+	defer wh.wg.Done()
+
+	for {
+		wait := wh.deliverDue(q)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-wh.stop:
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue delivers the queued events of q in order until the queue is
+// empty or a delivery has to wait for its next attempt. It returns how long
+// to wait before trying again.
+func (wh *Webhooks) deliverDue(q *queue) time.Duration {
+	for !wh.stopped() {
+		files, err := os.ReadDir(q.dir)
+		if err != nil {
+			wh.log.Error().Err(err).Str("endpoint", q.Name).Msg("failed to read webhook queue")
+			return MAX_BACKOFF
+		}
+		names := make([]string, 0, len(files))
+		for _, file := range files {
+			if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+				names = append(names, file.Name())
+			}
+		}
+		if len(names) == 0 {
+			return MAX_BACKOFF
+		}
+		sort.Strings(names)
+
+		file := filepath.Join(q.dir, names[0])
+		var d delivery
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &d)
+		}
+		if err != nil {
+			wh.log.Error().Err(err).Str("endpoint", q.Name).Str("file", file).Msg("dropping unreadable webhook delivery")
+			os.Rename(file, filepath.Join(q.dir, failedDir, names[0]))
+			continue
+		}
+
+		if wait := time.Until(d.NextAttempt); wait > 0 {
+			return wait
+		}
+
+		err = wh.send(q, d.Event)
+		d.Attempts++
+		switch {
+		case err == nil:
+			webhookDeliveries.WithLabelValues(q.Name, "success").Inc()
+			os.Remove(file)
+		case wh.ctx.Err() != nil:
+			// interrupted by Close, try again on the next start
+			return 0
+		case d.Attempts >= q.MaxAttempts:
+			webhookDeliveries.WithLabelValues(q.Name, "dropped").Inc()
+			wh.log.Error().Err(err).
+				Str("endpoint", q.Name).
+				Str("event", d.Event.ID).
+				Int("attempts", d.Attempts).
+				Msg("giving up on webhook delivery")
+			d.LastError = err.Error()
+			if data, err := json.Marshal(d); err == nil {
+				server.WriteFileAtomic(filepath.Join(q.dir, failedDir, names[0]), data)
+			}
+			os.Remove(file)
+		default:
+			webhookDeliveries.WithLabelValues(q.Name, "failure").Inc()
+			backoff := min(time.Second<<(d.Attempts-1), MAX_BACKOFF)
+			wh.log.Warn().Err(err).
+				Str("endpoint", q.Name).
+				Str("event", d.Event.ID).
+				Int("attempts", d.Attempts).
+				Dur("retry in", backoff).
+				Msg("webhook delivery failed")
+			d.NextAttempt = time.Now().Add(backoff)
+			d.LastError = err.Error()
+			if data, err := json.Marshal(d); err == nil {
+				server.WriteFileAtomic(file, data)
+			}
+			return backoff
+		}
+	}
+	return 0
+}
+
+func (wh *Webhooks) stopped() bool {
+	select {
+	case <-wh.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// send posts event to the endpoint of q.
+func (wh *Webhooks) send(q *queue, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(wh.ctx, q.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range q.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simple-reg")
+	req.Header.Set(EVENT_HEADER, event.Action)
+	req.Header.Set(DELIVERY_HEADER, event.ID)
+	if q.Secret != "" {
+		req.Header.Set(SIGNATURE_HEADER, Sign(q.Secret, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of body receivers compare the SIGNATURE_HEADER
+// against: "sha256=" followed by the hex encoded HMAC-SHA256 under secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	RATE_LIMIT_IP         = "ip"
+	RATE_LIMIT_USER       = "user"
+	RATE_LIMIT_REPOSITORY = "repository"
+
+	RATE_LIMIT_PULL = "pull"
+	RATE_LIMIT_PUSH = "push"
+
+	// bucketSweepInterval is how often buckets that refilled completely are
+	// dropped, so clients passing by do not pile up.
+	bucketSweepInterval = time.Minute
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "rate_limited_total",
+	Help:      "Requests rejected by rate limits by scope and action.",
+}, []string{"scope", "action"})
+
+// RateLimit allows Requests per Per with bursts of up to Burst requests, per
+// client IP, authenticated user or repository, for pulls or pushes.
+type RateLimit struct {
+	Scope    string
+	Action   string
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// ParseRateLimit parses "<scope>:<action>=<requests>/<duration>[:<burst>]",
+// e.g. "ip:pull=100/1s:200" or "user:push=600/1h". The duration may omit the
+// 1, as in "100/s". The burst defaults to the number of requests.
+func ParseRateLimit(value string) (RateLimit, error) {
+	key, limit, ok := strings.Cut(value, "=")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q: expected <scope>:<action>=<requests>/<duration>[:<burst>]", value)
+	}
+
+	rl := RateLimit{}
+	rl.Scope, rl.Action, _ = strings.Cut(key, ":")
+	switch rl.Scope {
+	case RATE_LIMIT_IP, RATE_LIMIT_USER, RATE_LIMIT_REPOSITORY:
+	default:
+		return RateLimit{}, fmt.Errorf("rate limit %q: unknown scope %q, expected ip, user or repository", value, rl.Scope)
+	}
+	if rl.Action != RATE_LIMIT_PULL && rl.Action != RATE_LIMIT_PUSH {
+		return RateLimit{}, fmt.Errorf("rate limit %q: unknown action %q, expected pull or push", value, rl.Action)
+	}
+
+	limit, burst, hasBurst := strings.Cut(limit, ":")
+	requests, per, ok := strings.Cut(limit, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q: expected <requests>/<duration>", value)
+	}
+
+	var err error
+	if rl.Requests, err = strconv.Atoi(requests); err != nil || rl.Requests < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: invalid number of requests %q", value, requests)
+	}
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	if rl.Per, err = time.ParseDuration(per); err != nil || rl.Per <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: invalid duration %q", value, per)
+	}
+
+	rl.Burst = rl.Requests
+	if hasBurst {
+		if rl.Burst, err = strconv.Atoi(burst); err != nil || rl.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("rate limit %q: invalid burst %q", value, burst)
+		}
+	}
+	return rl, nil
+}
+
+func (rl RateLimit) String() string {
+	return fmt.Sprintf("%s:%s=%d/%s:%d", rl.Scope, rl.Action, rl.Requests, rl.Per, rl.Burst)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket per key.
+type limiter struct {
+	sync.Mutex
+	RateLimit
+	// tokens added per second
+	rate      float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	return &limiter{
+		RateLimit: rl,
+		rate:      float64(rl.Requests) / rl.Per.Seconds(),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// take removes a token from the bucket of key. When it is empty, it returns
+// how long the caller has to wait for the next token instead.
+func (l *limiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) >= bucketSweepInterval {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= float64(l.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// refund returns a token taken from the bucket of key.
+func (l *limiter) refund(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	// a bucket swept in between was full anyway
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(float64(l.Burst), b.tokens+1)
+	}
+}
+
+type takenTokensKey struct{}
+
+// takenTokens are the tokens every rate limit middleware took for a
+// request. It travels in the request context, so a middleware rejecting the
+// request also gives back the tokens the middlewares before it took, e.g.
+// the client IP token taken before authentication when the user is limited.
+type takenTokens struct {
+	sync.Mutex
+	taken map[*limiter]string
+}
+
+// tokensOf returns the tokens taken for r so far and r carrying them.
+func tokensOf(r *http.Request) (*takenTokens, *http.Request) {
+	if tokens, ok := r.Context().Value(takenTokensKey{}).(*takenTokens); ok {
+		return tokens, r
+	}
+	tokens := &takenTokens{taken: map[*limiter]string{}}
+	return tokens, r.WithContext(context.WithValue(r.Context(), takenTokensKey{}, tokens))
+}
+
+func (t *takenTokens) add(l *limiter, key string) {
+	t.Lock()
+	defer t.Unlock()
+	t.taken[l] = key
+}
+
+// refund gives back every token taken for the request.
+func (t *takenTokens) refund() {
+	t.Lock()
+	defer t.Unlock()
+	for l, key := range t.taken {
+		l.refund(key)
+	}
+	clear(t.taken)
+}
+
+// key returns the bucket r falls into, or false if the limit does not
+// apply to r.
+func (l *limiter) key(r *http.Request) (string, bool) {
+	action := RATE_LIMIT_PUSH
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		action = RATE_LIMIT_PULL
+	}
+	if action != l.Action {
+		return "", false
+	}
+
+	switch l.Scope {
+	case RATE_LIMIT_IP:
+		return ClientIP(r), true
+	case RATE_LIMIT_USER:
+		return UserFromRequest(r)
+	case RATE_LIMIT_REPOSITORY:
+		repo := mux.Vars(r)["name"]
+		return repo, repo != ""
+	}
+	return "", false
+}
+
+// WithRateLimits rejects requests exceeding one of limits with
+// TOOMANYREQUESTS and a Retry-After header. Limits on users have to be added
+// after the authentication middleware, limits on client IPs are best added
+// before it so they also cover failed logins. A rejected request gives back
+// the tokens it took from every limit, including those of earlier calls.
+func (s *Server) WithRateLimits(limits ...RateLimit) *Server {
+	if len(limits) == 0 {
+		return s
+	}
+
+	limiters := make([]*limiter, 0, len(limits))
+	for _, limit := range limits {
+		limiters = append(limiters, newLimiter(limit))
+	}
+
+	return s.WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// take a token from every limit, so a request rejected by one
+			// limit can give back the tokens it took from the others
+			now := time.Now()
+			tokens, r := tokensOf(r)
+			rejected := false
+			retryAfter := time.Duration(0)
+			for _, l := range limiters {
+				key, ok := l.key(r)
+				if !ok {
+					continue
+				}
+				allowed, wait := l.take(key, now)
+				if allowed {
+					tokens.add(l, key)
+					continue
+				}
+
+				rejected = true
+				retryAfter = max(retryAfter, wait)
+				rateLimited.WithLabelValues(l.Scope, l.Action).Inc()
+				Logger(r).Info().
+					Str("limit", l.String()).
+					Str("key", key).
+					Msg("rate limited")
+			}
+
+			if rejected {
+				tokens.refund()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				WriteErrors(w, r, ERROR_TOOMANYREQUESTS)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
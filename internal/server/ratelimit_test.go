@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimitsRefundRejectedRequests(t *testing.T) {
+	svr := NewServer().WithRouter(mux.NewRouter())
+	svr.WithRateLimits(
+		RateLimit{Scope: RATE_LIMIT_IP, Action: RATE_LIMIT_PULL, Requests: 2, Per: time.Hour, Burst: 2},
+		RateLimit{Scope: RATE_LIMIT_REPOSITORY, Action: RATE_LIMIT_PULL, Requests: 1, Per: time.Hour, Burst: 1},
+	)
+	svr.WithHandlerFunc("/v2/{name}/tags/list", func(w http.ResponseWriter, r *http.Request) {}, http.MethodGet)
+
+	tests := []struct {
+		repo   string
+		status int
+	}{
+		{"a", http.StatusOK},
+		// rejected by the repository limit, the IP token is given back
+		{"a", http.StatusTooManyRequests},
+		{"b", http.StatusOK},
+		{"c", http.StatusTooManyRequests},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		svr.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/"+test.repo+"/tags/list", nil))
+		if w.Code != test.status {
+			t.Fatalf("request %d to %s answered %d, want %d", i, test.repo, w.Code, test.status)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d rejected without Retry-After", i)
+		}
+	}
+}
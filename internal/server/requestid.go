@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// request IDs of clients are only accepted if they can not break log lines
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// withRequestContext accepts the client's request ID or generates one,
+// returns it in the response and attaches a logger carrying it to the
+// request.
+func (s *Server) withRequestContext(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if !requestIDRegexp.MatchString(id) {
+		id = uuid.NewString()
+	}
+	w.Header().Set(REQUEST_ID_HEADER, id)
+
+	logger := s.log.With().Str("request id", id).Logger()
+	r = r.WithContext(logger.WithContext(r.Context()))
+	return withRequestInfo(r, &requestInfo{clientIP: s.clientIP(r), requestID: id})
+}
+
+// RequestID returns the ID of r, which is logged with every message about it.
+func RequestID(r *http.Request) string {
+	return requestInfoFrom(r).requestID
+}
+
+// Logger returns the logger of r, which adds the request ID to every message.
+func Logger(r *http.Request) *zerolog.Logger {
+	return zerolog.Ctx(r.Context())
+}
@@ -1,9 +1,15 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,6 +18,9 @@ import (
 
 const (
 	DEFAULT_PORT = 8080
+	// DEFAULT_SHUTDOWN_TIMEOUT stays below the 30 second grace period
+	// Kubernetes gives a pod before killing it.
+	DEFAULT_SHUTDOWN_TIMEOUT = 25 * time.Second
 )
 
 var (
@@ -20,17 +29,33 @@ var (
 )
 
 type Server struct {
-	log         zerolog.Logger
-	port        int
-	Router      *mux.Router
-	logRequests bool
+	log             zerolog.Logger
+	port            int
+	addr            string
+	Router          *mux.Router
+	logRequests     bool
+	tlsOptions      *TLSOptions
+	metricsAddr     string
+	shutdownTimeout time.Duration
+	shutdownHooks   []func(context.Context) error
+	drainHooks      []func()
+	healthChecks    []healthCheck
+	trustedProxies  []*net.IPNet
+	timeouts        Timeouts
 }
 
 func NewServer() *Server {
 	return &Server{
-		log:    DEFAULT_LOGGER,
-		port:   DEFAULT_PORT,
-		Router: DEFAULT_ROUTER,
+		log:             DEFAULT_LOGGER,
+		port:            DEFAULT_PORT,
+		Router:          DEFAULT_ROUTER,
+		shutdownTimeout: DEFAULT_SHUTDOWN_TIMEOUT,
+		timeouts: Timeouts{
+			ReadHeader: DEFAULT_READ_HEADER_TIMEOUT,
+			Read:       DEFAULT_READ_TIMEOUT,
+			Write:      DEFAULT_WRITE_TIMEOUT,
+			Idle:       DEFAULT_IDLE_TIMEOUT,
+		},
 	}
 }
 
@@ -43,45 +68,19 @@ func (s *Server) WithLogger(logger zerolog.Logger) *Server {
 	return s
 }
 
+// WithLogRequest logs every request as JSON through the server's logger.
 func (s *Server) WithLogRequest() *Server {
-	s.WithMiddleware(s.logRequestMiddleware)
-	return s
-}
-
-func (s *Server) logRequestMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Wrap the response writer to capture the status code
-		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(rw, r)
-
-		duration := time.Since(start)
-		fullURL := fmt.Sprintf("%s://%s%s", GetScheme(r), r.Host, r.RequestURI)
-
-		level := s.log.Debug()
-		if rw.statusCode >= 500 {
-			level = s.log.Error()
-		}
-
-		level.
-			Str("url", fullURL).
-			Str("method", r.Method).
-			Int("status code", rw.statusCode).
-			Int("duration", int(duration.Milliseconds())).
-			Str("content", string(rw.content)).
-			Any("args", rw.Header()).
-			Msg("request")
-	})
+	return s.WithAccessLog(AccessLogOptions{})
 }
 
+// responseWriter records the status code and the number of bytes written and
+// captures the start of the body when body is set.
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode   int
-	wroteHeader  bool
-	wroteContent bool
-	content      []byte
+	statusCode  int
+	wroteHeader bool
+	written     int64
+	body        *cappedBuffer
 }
 
 // WriteHeader sets the status code
@@ -95,14 +94,67 @@ func (rw *responseWriter) WriteHeader(code int) {
 
 // Write writes the body and sets 200 if not already set
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.wroteContent = true
-	rw.content = append(rw.content, b...)
-
 	if !rw.wroteHeader {
 		// Status code not explicitly set, default to 200
 		rw.WriteHeader(http.StatusOK)
 	}
-	return rw.ResponseWriter.Write(b)
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	if rw.body != nil {
+		rw.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body and captures the
+// start of it when body is set.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+	body *cappedBuffer
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.read += int64(n)
+	if cr.body != nil {
+		cr.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// cappedBuffer keeps the first limit bytes written to it.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(b []byte) (int, error) {
+	if room := cb.limit - cb.Len(); len(b) > room {
+		cb.truncated = true
+		cb.Buffer.Write(b[:max(room, 0)])
+		return len(b), nil
+	}
+	return cb.Buffer.Write(b)
+}
+
+func (cb *cappedBuffer) String() string {
+	if cb.truncated {
+		return cb.Buffer.String() + "..."
+	}
+	return cb.Buffer.String()
 }
 
 func (s *Server) WithPort(port int) *Server {
@@ -110,6 +162,13 @@ func (s *Server) WithPort(port int) *Server {
 	return s
 }
 
+// WithAddr sets the address to listen on, e.g. "127.0.0.1:5000". It takes
+// precedence over the port.
+func (s *Server) WithAddr(addr string) *Server {
+	s.addr = addr
+	return s
+}
+
 func (s *Server) WithRouter(router *mux.Router) *Server {
 	s.Router = router
 	return s
@@ -120,7 +179,105 @@ func (s *Server) WithMiddleware(middleware func(http.Handler) http.Handler) *Ser
 	return s
 }
 
+// WithShutdownTimeout sets how long in-flight requests may take to finish
+// once the server is asked to stop.
+func (s *Server) WithShutdownTimeout(timeout time.Duration) *Server {
+	s.shutdownTimeout = timeout
+	return s
+}
+
+// WithShutdownHook registers hook to run after the server stopped serving
+// requests, e.g. to flush state to disk. Hooks run in reverse order of
+// registration, like deferred calls.
+func (s *Server) WithShutdownHook(hook func(context.Context) error) *Server {
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+	return s
+}
+
+// WithDrainHook registers hook to run as soon as the server starts shutting
+// down, before in-flight requests are drained, e.g. to end streaming
+// responses that would otherwise hold up the shutdown. It must not block.
+func (s *Server) WithDrainHook(hook func()) *Server {
+	s.drainHooks = append(s.drainHooks, hook)
+	return s
+}
+
+// ListenAndServe serves until SIGINT or SIGTERM is received. It then stops
+// accepting connections, waits up to the shutdown timeout for in-flight
+// requests and runs the shutdown hooks.
 func (s *Server) ListenAndServe() {
-	s.log.Print("Server started on port ", s.port)
-	s.log.Error().AnErr("startup", http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.Router))
+	svr := &http.Server{
+		Addr:              s.addr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		IdleTimeout:       s.timeouts.Idle,
+	}
+	if svr.Addr == "" {
+		svr.Addr = fmt.Sprintf(":%d", s.port)
+	}
+	for _, hook := range s.drainHooks {
+		svr.RegisterOnShutdown(hook)
+	}
+
+	if s.tlsOptions != nil {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			s.log.Error().AnErr("startup", err).Send()
+			return
+		}
+		svr.TLSConfig = tlsConfig
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 2)
+	go func() {
+		if svr.TLSConfig != nil {
+			s.log.Print("Server started with TLS on ", svr.Addr)
+			errs <- svr.ListenAndServeTLS("", "")
+			return
+		}
+		s.log.Print("Server started on ", svr.Addr)
+		errs <- svr.ListenAndServe()
+	}()
+
+	var metrics *http.Server
+	if s.metricsAddr != "" {
+		metrics = s.metricsServer()
+		go func() {
+			s.log.Print("Metrics served on ", metrics.Addr)
+			errs <- metrics.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		s.log.Error().AnErr("startup", err).Send()
+		return
+	case <-ctx.Done():
+		stop()
+	}
+
+	s.log.Info().Dur("timeout", s.shutdownTimeout).Msg("shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if err := svr.Shutdown(shutdownCtx); err != nil {
+		s.log.Error().Err(err).Msg("in-flight requests did not finish in time, closing connections")
+		svr.Close()
+	}
+	if metrics != nil {
+		metrics.Close()
+	}
+
+	hookCtx, cancelHooks := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancelHooks()
+	for i := len(s.shutdownHooks) - 1; i >= 0; i-- {
+		if err := s.shutdownHooks[i](hookCtx); err != nil {
+			s.log.Error().Err(err).Msg("shutdown hook failed")
+		}
+	}
+
+	s.log.Info().Msg("server stopped")
 }
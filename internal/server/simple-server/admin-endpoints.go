@@ -0,0 +1,123 @@
+package simpleserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+)
+
+type TagHistory struct {
+	Name    string                            `json:"name"`
+	Tag     string                            `json:"tag"`
+	History []manifestservice.TagHistoryEntry `json:"history"`
+}
+
+type TagRollback struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+// Usage is the storage used by a repository or namespace. Bytes counts the
+// manifests and every distinct blob they reference, Uploading the uploads in
+// progress. Quota is 0 when none is configured for exactly this repository
+// or namespace.
+type Usage struct {
+	Name      string `json:"name"`
+	Bytes     int64  `json:"bytes"`
+	Uploading int64  `json:"uploading"`
+	Quota     int64  `json:"quota,omitempty"`
+}
+
+type UsageReport struct {
+	Repositories []Usage `json:"repositories"`
+	Namespaces   []Usage `json:"namespaces"`
+}
+
+func handleGetTagHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["name"]
+	tag := vars["tag"]
+
+	history, err := manifestService.GetTagHistory(repo, tag)
+	if err != nil {
+		writeManifestError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(TagHistory{
+		Name:    repo,
+		Tag:     tag,
+		History: history,
+	}); err != nil {
+		server.Logger(r).Warn().Err(err).Msg("failed to write response")
+	}
+}
+
+func handleRollbackTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["name"]
+	tag := vars["tag"]
+
+	digest := r.URL.Query().Get("digest")
+	if digest != "" && !server.IsValidDigest(digest) {
+		server.WriteErrors(w, r, server.ERROR_DIGEST_INVALID)
+		return
+	}
+
+	digest, err := manifestService.RollbackTag(r.Context(), repo, tag, digest, identity(r))
+	if errors.Is(err, manifestservice.ErrManifestUnknown) {
+		server.WriteErrors(w, r, server.ERROR_MANIFEST_UNKNOWN)
+		return
+	}
+	if errors.Is(err, manifestservice.ErrTagImmutable) {
+		server.WriteErrors(w, r, server.ERROR_DENIED)
+		return
+	}
+	if errors.Is(err, manifestservice.ErrNoPreviousTag) {
+		server.WriteErrorsStatus(w, r, http.StatusConflict, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+	if err != nil {
+		server.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(TagRollback{
+		Name:   repo,
+		Tag:    tag,
+		Digest: digest,
+	}); err != nil {
+		server.Logger(r).Warn().Err(err).Msg("failed to write response")
+	}
+}
+
+func handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	writeUsageReport(w, r, "")
+}
+
+func handleGetRepositoryUsage(w http.ResponseWriter, r *http.Request) {
+	writeUsageReport(w, r, mux.Vars(r)["name"])
+}
+
+func writeUsageReport(w http.ResponseWriter, r *http.Request, repo string) {
+	report := usageReport(repo)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		server.Logger(r).Warn().Err(err).Msg("failed to write response")
+	}
+}
@@ -0,0 +1,47 @@
+package simpleserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+func TestTagHistoryErrors(t *testing.T) {
+	useTempStorage(t)
+	if status := pushManifest("app", "v1"); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+	// a history that cannot be read
+	if err := os.MkdirAll(filepath.Join(ManifestDir, "app", "_history", "broken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tag     string
+		status  int
+		message string
+	}{
+		{"other", "v1", http.StatusNotFound, server.ERROR_NAME_UNKNOWN.Message},
+		{"app", "v2", http.StatusNotFound, server.ERROR_MANIFEST_UNKNOWN.Message},
+		{"app", "broken", http.StatusInternalServerError, server.ERROR_UNKNOWN.Message},
+	}
+	for _, test := range tests {
+		vars := map[string]string{"name": test.name, "tag": test.tag}
+		w := serve(handleGetTagHistory, http.MethodGet, "/admin/"+test.name+"/tags/"+test.tag+"/history", vars, "")
+		if message := errorMessage(t, w); w.Code != test.status || message != test.message {
+			t.Errorf("history of %s:%s answered %d %s, want %d %s", test.name, test.tag, w.Code, message, test.status, test.message)
+		}
+	}
+
+	vars := map[string]string{"name": "app", "tag": "v1"}
+	w := serve(handleGetTagHistory, http.MethodGet, "/admin/app/tags/v1/history", vars, "")
+	var history TagHistory
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil || w.Code != http.StatusOK || len(history.History) != 1 {
+		t.Fatalf("history of app:v1 answered %d %+v", w.Code, history)
+	}
+}
@@ -0,0 +1,78 @@
+package simpleserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	auditservice "github.com/nilspolek/simple-reg/internal/server/audit-service"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+	"github.com/rs/zerolog"
+)
+
+var auditLog *auditservice.Log
+
+// SetAuditLog records every push, upload, deletion and retag to log.
+func SetAuditLog(log *auditservice.Log) {
+	auditLog = log
+}
+
+// audit records a blob upload r made. The upload already happened, so a
+// failure to record it is logged rather than failing the request.
+func audit(r *http.Request, action, repo, reference, digest string) {
+	caller := server.CallerFromContext(r.Context())
+	appendAudit(server.Logger(r), auditservice.Record{
+		Action:     action,
+		Repository: repo,
+		Reference:  reference,
+		Digest:     digest,
+		Identity:   caller.User,
+		Address:    caller.ClientIP,
+		RequestID:  caller.RequestID,
+	})
+}
+
+// auditRecorder records the changes of the manifest service, including the
+// tags expired by retention policies. The manifest service calls it while
+// the change is still locked, so the records are in the order of the
+// changes.
+type auditRecorder struct{}
+
+func (auditRecorder) Record(ctx context.Context, event notificationservice.Event) {
+	record := auditservice.Record{
+		Repository: event.Repository,
+		Reference:  event.Tag,
+		Digest:     event.Digest,
+		Identity:   event.Actor,
+		Address:    event.Address,
+		RequestID:  event.RequestID,
+	}
+	switch event.Action {
+	case notificationservice.EVENT_PUSH:
+		record.Action = auditservice.ACTION_PUSH
+	case notificationservice.EVENT_DELETE:
+		record.Action = auditservice.ACTION_DELETE
+	case notificationservice.EVENT_TAG:
+		record.Action = auditservice.ACTION_RETAG
+	default:
+		return
+	}
+	if record.Reference == "" {
+		record.Reference = event.Digest
+	}
+	appendAudit(zerolog.Ctx(ctx), record)
+}
+
+func appendAudit(logger *zerolog.Logger, record auditservice.Record) {
+	if auditLog == nil {
+		return
+	}
+
+	if err := auditLog.Append(record); err != nil {
+		logger.Error().Err(err).
+			Str("action", record.Action).
+			Str("repository", record.Repository).
+			Str("reference", record.Reference).
+			Msg("failed to write audit record")
+	}
+}
@@ -0,0 +1,85 @@
+package simpleserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	auditservice "github.com/nilspolek/simple-reg/internal/server/audit-service"
+)
+
+func TestAuditRecordsTagMoves(t *testing.T) {
+	useTempStorage(t)
+	for _, layer := range []string{"a", "b"} {
+		if status := upload("app", layer); status != http.StatusCreated {
+			t.Fatalf("upload answered %d", status)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := auditservice.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAuditLog(log)
+	t.Cleanup(func() {
+		SetAuditLog(nil)
+		log.Close()
+	})
+
+	rollback := func(digest string) int {
+		vars := map[string]string{"name": "app", "tag": "v1"}
+		return serve(handleRollbackTag, http.MethodPost, "/admin/app/tags/v1/rollback?digest="+digest, vars, "").Code
+	}
+
+	if status := pushManifest("app", "v1", "a"); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+	first := resolveTag(t, "app", "v1")
+	// pushing the same manifest and rolling back to the current digest
+	// leave the tag where it is
+	if status := pushManifest("app", "v1", "a"); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+	if status := rollback(first); status != http.StatusOK {
+		t.Fatalf("rollback answered %d", status)
+	}
+	if status := pushManifest("app", "v1", "b"); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+	if status := rollback(first); status != http.StatusOK {
+		t.Fatalf("rollback answered %d", status)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	actions := make([]string, 0)
+	if _, err := auditservice.Verify(file, func(record auditservice.Record) {
+		actions = append(actions, record.Action)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		auditservice.ACTION_PUSH, auditservice.ACTION_RETAG,
+		auditservice.ACTION_PUSH,
+		auditservice.ACTION_PUSH, auditservice.ACTION_RETAG,
+		auditservice.ACTION_RETAG,
+	}
+	if !slices.Equal(actions, want) {
+		t.Errorf("recorded %v, want %v", actions, want)
+	}
+}
+
+func resolveTag(t *testing.T, repo, tag string) string {
+	t.Helper()
+	_, digest, err := manifestService.GetManifest(t.Context(), repo, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
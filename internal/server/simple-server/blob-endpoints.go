@@ -1,14 +1,19 @@
 package simpleserver
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"net/http"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/nilspolek/simple-reg/internal/server"
+	auditservice "github.com/nilspolek/simple-reg/internal/server/audit-service"
+	blobservice "github.com/nilspolek/simple-reg/internal/server/blob-service"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func handleStartUpload(w http.ResponseWriter, r *http.Request) {
@@ -16,8 +21,14 @@ func handleStartUpload(w http.ResponseWriter, r *http.Request) {
 	repo := vars["name"]
 	uploadID := uuid.New()
 
-	if err := blobService.StartUpload(uploadID); err != nil {
-		server.WriteErrors(w, server.ERROR_BLOB_UNKNOWN)
+	if err := usage.startUpload(uploadID, repo); err != nil {
+		writeQuotaExceeded(w, r, repo)
+		return
+	}
+
+	if err := blobService.StartUpload(r.Context(), uploadID, repo); err != nil {
+		usage.endUpload(uploadID, "")
+		server.WriteErrors(w, r, server.ERROR_BLOB_UNKNOWN)
 		return
 	}
 
@@ -33,12 +44,54 @@ func handleStartUpload(w http.ResponseWriter, r *http.Request) {
 
 func handlePatchBlob(w http.ResponseWriter, r *http.Request) {
 	sessionID := uuid.MustParse(mux.Vars(r)["id"])
+	repo := mux.Vars(r)["name"]
+
+	body := r.Body
+	if MaxBlobSize > 0 {
+		size, err := blobService.UploadSize(sessionID, repo)
+		if errors.Is(err, blobservice.ErrUploadNotFound) {
+			server.WriteErrors(w, r, server.ERROR_BLOB_UPLOAD_UNKNOWN)
+			return
+		}
+		if err != nil {
+			server.WriteInternalError(w, r, err)
+			return
+		}
+		if r.ContentLength > MaxBlobSize-size {
+			writeTooLarge(w, r, server.ERROR_BLOB_TOO_LARGE, MaxBlobSize)
+			return
+		}
+		body = http.MaxBytesReader(w, body, MaxBlobSize-size)
+	}
+
+	if remaining, ok := usage.uploadHeadroom(sessionID); ok && (remaining < 0 || r.ContentLength > remaining) {
+		writeQuotaExceeded(w, r, repo)
+		return
+	}
+	// chunked requests announce no length, so count while writing
+	body = &quotaReader{ReadCloser: body, id: sessionID}
 
-	end, err := blobService.WriteChunk(sessionID, r.Body)
+	end, err := blobService.WriteChunk(r.Context(), sessionID, repo, body)
 	defer r.Body.Close()
 
+	if errors.Is(err, blobservice.ErrUploadNotFound) {
+		server.WriteErrors(w, r, server.ERROR_BLOB_UPLOAD_UNKNOWN)
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaExceeded(w, r, repo)
+		return
+	}
+	if isTooLarge(err) {
+		writeTooLarge(w, r, server.ERROR_BLOB_TOO_LARGE, MaxBlobSize)
+		return
+	}
+	if isTimeout(err) {
+		writeTimeout(w, r, server.ERROR_BLOB_UPLOAD_INVALID, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		server.WriteInternalError(w, r, err)
 		return
 	}
 
@@ -57,12 +110,31 @@ func handleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
 	repo := vars["name"]
 
 	digest := r.URL.Query().Get("digest")
-	if digest == "" {
-		http.Error(w, "digest required", http.StatusBadRequest)
+	if !server.IsValidDigest(digest) {
+		server.WriteErrors(w, r, server.ERROR_DIGEST_INVALID)
 		return
 	}
 
-	blobService.FinalizeUpload(uploadID, digest)
+	err := blobService.FinalizeUpload(r.Context(), uploadID, repo, digest)
+	if errors.Is(err, blobservice.ErrUploadNotFound) {
+		// the session may belong to another repository and go on there
+		server.WriteErrors(w, r, server.ERROR_BLOB_UPLOAD_UNKNOWN)
+		return
+	}
+	if err != nil {
+		usage.endUpload(uploadID, "")
+	} else {
+		usage.endUpload(uploadID, digest)
+	}
+	if errors.Is(err, blobservice.ErrDigestMismatch) || errors.Is(err, blobservice.ErrInvalidDigest) {
+		server.WriteErrors(w, r, server.ERROR_DIGEST_INVALID)
+		return
+	}
+	if err != nil {
+		server.WriteInternalError(w, r, err)
+		return
+	}
+	audit(r, auditservice.ACTION_UPLOAD, repo, "", digest)
 
 	location := fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)
 	w.Header().Set("Location", location)
@@ -72,20 +144,37 @@ func handleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
+func handleCancelUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uploadID := uuid.MustParse(vars["id"])
+
+	err := blobService.CancelUpload(r.Context(), uploadID, vars["name"])
+	if errors.Is(err, blobservice.ErrUploadNotFound) {
+		server.WriteErrors(w, r, server.ERROR_BLOB_UPLOAD_UNKNOWN)
+		return
+	}
+	usage.endUpload(uploadID, "")
+	if err != nil {
+		server.WriteInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func handleGetBlob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	digest := vars["digest"]
 
-	blob, err := blobService.StreamBlob(digest)
-	defer blob.Close()
+	blob, err := blobService.StreamBlob(r.Context(), vars["name"], digest)
 	if err != nil {
-		http.Error(w, "blob not found", http.StatusNotFound)
+		writeBlobError(w, r, err)
 		return
 	}
+	defer blob.Close()
 
 	info, err := blob.Stat()
 	if err != nil {
-		http.Error(w, "failed to stat blob file", http.StatusInternalServerError)
+		server.WriteInternalError(w, r, err)
 		return
 	}
 
@@ -96,25 +185,29 @@ func handleGetBlob(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	// Dateiinhalt streamen
-	if _, err := io.Copy(w, blob); err != nil {
-		log.Println("error while streaming blob:", err)
+	_, span := tracer.Start(r.Context(), "send blob")
+	n, err := io.Copy(w, blob)
+	span.SetAttributes(attribute.Int64("blob.bytes_sent", n))
+	server.EndSpan(span, err)
+	if err != nil {
+		server.Logger(r).Warn().Err(err).Str("digest", digest).Msg("failed to stream blob")
 	}
 }
 
 func handleBlobHeaders(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	digest := vars["digest"] // e.g., "sha256:abc123...	if !sha256Regex.MatchString(digest) {
+	digest := vars["digest"]
 
-	blob, err := blobService.StreamBlob(digest)
+	blob, err := blobService.StreamBlob(r.Context(), vars["name"], digest)
 	if err != nil {
-		http.Error(w, "blob not found", http.StatusNotFound)
+		writeBlobError(w, r, err)
 		return
 	}
 	defer blob.Close()
 
 	info, err := blob.Stat()
 	if err != nil {
-		http.Error(w, "failed to stat blob file", http.StatusInternalServerError)
+		server.WriteInternalError(w, r, err)
 		return
 	}
 
@@ -124,3 +217,25 @@ func handleBlobHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
 	w.WriteHeader(http.StatusOK)
 }
+
+// writeBlobError answers a failure to open a blob, missing blobs and blobs
+// of other repositories are BLOB_UNKNOWN.
+func writeBlobError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, blobservice.ErrInvalidDigest) || errors.Is(err, blobservice.ErrBlobUnknown) {
+		server.WriteErrors(w, r, server.ERROR_BLOB_UNKNOWN)
+		return
+	}
+	server.WriteInternalError(w, r, err)
+}
+
+// blobLinker links the blobs referenced by manifests pushed to a repository
+// to that repository.
+type blobLinker struct{}
+
+func (blobLinker) Link(repo, digest string) error {
+	err := blobService.Link(repo, digest)
+	if errors.Is(err, blobservice.ErrBlobUnknown) || errors.Is(err, blobservice.ErrInvalidDigest) {
+		return fmt.Errorf("%w: %s", manifestservice.ErrBlobUnknown, digest)
+	}
+	return err
+}
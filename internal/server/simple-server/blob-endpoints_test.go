@@ -0,0 +1,173 @@
+package simpleserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	blobservice "github.com/nilspolek/simple-reg/internal/server/blob-service"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	"github.com/rs/zerolog"
+)
+
+// useTempStorage points the services at empty directories for the
+// duration of t.
+func useTempStorage(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	blobDir, manifestDir := BlobDir, ManifestDir
+	BlobDir = filepath.Join(dir, "blobs")
+	ManifestDir = filepath.Join(dir, "manifests")
+	blobservice.BlobDir = BlobDir
+	manifestservice.ManifestDir = ManifestDir
+	for _, dir := range []string{BlobDir, ManifestDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := usage.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		BlobDir, ManifestDir = blobDir, manifestDir
+		blobservice.BlobDir = blobDir
+		manifestservice.ManifestDir = manifestDir
+	})
+}
+
+// startUpload opens an upload session for repo holding content.
+func startUpload(t *testing.T, repo, content string) uuid.UUID {
+	t.Helper()
+
+	id := uuid.New()
+	if err := blobService.StartUpload(context.Background(), id, repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobService.WriteChunk(context.Background(), id, repo, io.NopCloser(strings.NewReader(content))); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func sha256Digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestFinalizeUpload(t *testing.T) {
+	useTempStorage(t)
+
+	tests := []struct {
+		name   string
+		id     func() uuid.UUID
+		digest string
+		status int
+	}{
+		{"stored", func() uuid.UUID { return startUpload(t, "app", "layer") }, sha256Digest("layer"), http.StatusCreated},
+		{"digest mismatch", func() uuid.UUID { return startUpload(t, "app", "layer") }, sha256Digest("other"), http.StatusBadRequest},
+		{"unknown upload", uuid.New, sha256Digest("missing"), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := test.id()
+			r := httptest.NewRequest(http.MethodPut, "/v2/app/blobs/uploads/"+id.String()+"?digest="+test.digest, nil)
+			r = mux.SetURLVars(r, map[string]string{"name": "app", "id": id.String()})
+			w := httptest.NewRecorder()
+			handleFinalizeUpload(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			_, err := blobService.Size(strings.TrimPrefix(test.digest, "sha256:"))
+			stored := err == nil
+			if stored != (test.status == http.StatusCreated) {
+				t.Errorf("blob stored = %v after status %d", stored, w.Code)
+			}
+			if w.Code != http.StatusCreated && w.Header().Get("Docker-Content-Digest") != "" {
+				t.Errorf("failed upload announced digest %s", w.Header().Get("Docker-Content-Digest"))
+			}
+		})
+	}
+}
+
+func TestBlobsOfOtherRepositories(t *testing.T) {
+	useTempStorage(t)
+	if status := upload("app", "layer"); status != http.StatusCreated {
+		t.Fatalf("upload answered %d", status)
+	}
+	digest := sha256Digest("layer")
+
+	for _, test := range []struct {
+		name   string
+		status int
+	}{{"app", http.StatusOK}, {"other", http.StatusNotFound}} {
+		vars := map[string]string{"name": test.name, "digest": digest}
+		for _, handler := range []http.HandlerFunc{handleGetBlob, handleBlobHeaders} {
+			if w := serve(handler, http.MethodGet, "/v2/"+test.name+"/blobs/"+digest, vars, ""); w.Code != test.status {
+				t.Errorf("blob of %s answered %d, want %d", test.name, w.Code, test.status)
+			}
+		}
+	}
+
+	// referencing the blob does not make it readable
+	if status := pushManifest("other", "v1", "layer"); status != http.StatusBadRequest {
+		t.Errorf("push referencing a foreign blob answered %d, want %d", status, http.StatusBadRequest)
+	}
+	vars := map[string]string{"name": "other", "digest": digest}
+	if w := serve(handleGetBlob, http.MethodGet, "/v2/other/blobs/"+digest, vars, ""); w.Code != http.StatusNotFound {
+		t.Errorf("blob of other answered %d after push, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestUploadsOfOtherRepositories(t *testing.T) {
+	useTempStorage(t)
+	id := startUpload(t, "app", "lay").String()
+
+	vars := map[string]string{"name": "other", "id": id}
+	target := "/v2/other/blobs/uploads/" + id
+	if w := serve(handlePatchBlob, http.MethodPatch, target, vars, "er"); w.Code != http.StatusNotFound || errorMessage(t, w) != "BLOB_UPLOAD_UNKNOWN" {
+		t.Errorf("patch through other answered %d", w.Code)
+	}
+	if w := serve(handleFinalizeUpload, http.MethodPut, target+"?digest="+sha256Digest("lay"), vars, ""); w.Code != http.StatusNotFound || errorMessage(t, w) != "BLOB_UPLOAD_UNKNOWN" {
+		t.Errorf("finalize through other answered %d", w.Code)
+	}
+
+	// the session goes on in its own repository
+	vars["name"] = "app"
+	target = "/v2/app/blobs/uploads/" + id
+	if w := serve(handlePatchBlob, http.MethodPatch, target, vars, "er"); w.Code != http.StatusAccepted {
+		t.Fatalf("patch answered %d", w.Code)
+	}
+	if w := serve(handleFinalizeUpload, http.MethodPut, target+"?digest="+sha256Digest("layer"), vars, ""); w.Code != http.StatusCreated {
+		t.Fatalf("finalize answered %d", w.Code)
+	}
+}
+
+func TestPushAfterGarbageCollection(t *testing.T) {
+	useTempStorage(t)
+	grace := BlobGracePeriod
+	BlobGracePeriod = 0
+	t.Cleanup(func() { BlobGracePeriod = grace })
+
+	if status := upload("app", "layer"); status != http.StatusCreated {
+		t.Fatalf("upload answered %d", status)
+	}
+	runRetention(zerolog.Nop())
+
+	// the unreferenced layer is gone, a manifest cannot reference it anymore
+	if status := pushManifest("app", "v1", "layer"); status != http.StatusBadRequest {
+		t.Errorf("push referencing a collected blob answered %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,185 @@
+package simpleserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+)
+
+const (
+	// EVENTS_HEARTBEAT is how often an idle event stream sends a comment, so
+	// proxies keep it open and clients that went away are noticed.
+	EVENTS_HEARTBEAT = 15 * time.Second
+	// DEFAULT_EVENTS_WAIT and MAX_EVENTS_WAIT bound how long a long-poll
+	// waits for events.
+	DEFAULT_EVENTS_WAIT = 30 * time.Second
+	MAX_EVENTS_WAIT     = 5 * time.Minute
+)
+
+// EventPage answers a long-poll. Last is the sequence number to pass as
+// after to get the following events.
+type EventPage struct {
+	Events []notificationservice.LoggedEvent `json:"events"`
+	Last   int64                             `json:"last"`
+}
+
+// handleGetEvents streams events as server-sent events to clients accepting
+// text/event-stream and answers everyone else with the events after the
+// given sequence number, waiting for one if there is none yet.
+func handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := notificationservice.Filter{
+		Repositories: splitList(query["repository"]),
+		Actions:      splitList(query["action"]),
+	}
+	if err := filter.Validate(); err != nil {
+		server.WriteErrors(w, r, server.ERROR_BAD_REQUEST.WithDetails(err.Error()))
+		return
+	}
+
+	// EventSource sends Last-Event-ID when it reconnects, without either
+	// only new events are returned
+	after := events.Last()
+	if value := r.Header.Get("Last-Event-ID"); value != "" || query.Has("after") {
+		if value == "" {
+			value = query.Get("after")
+		}
+		seq, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seq < 0 {
+			server.WriteErrors(w, r, server.ERROR_BAD_REQUEST.WithDetails(fmt.Sprintf("invalid event ID %q", value)))
+			return
+		}
+		after = seq
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamEvents(w, r, after, filter)
+		return
+	}
+
+	wait := DEFAULT_EVENTS_WAIT
+	if value := query.Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			server.WriteErrors(w, r, server.ERROR_BAD_REQUEST.WithDetails(fmt.Sprintf("invalid wait %q", value)))
+			return
+		}
+		wait = min(d, MAX_EVENTS_WAIT)
+	}
+	pollEvents(w, r, after, filter, wait)
+}
+
+func streamEvents(w http.ResponseWriter, r *http.Request, after int64, filter notificationservice.Filter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	heartbeat := time.NewTicker(EVENTS_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		changed := events.Changed()
+		batch, last, err := events.Since(after, filter.Matches)
+		if errors.Is(err, notificationservice.ErrEventsDropped) {
+			// tell the client it missed events, the retained ones follow
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", last); err != nil {
+				return
+			}
+			after = last
+			continue
+		}
+		for _, event := range batch {
+			data, err := json.Marshal(event.Event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.Seq, data); err != nil {
+				return
+			}
+		}
+		after = last
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if events.Closed() {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func pollEvents(w http.ResponseWriter, r *http.Request, after int64, filter notificationservice.Filter, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var page EventPage
+poll:
+	for {
+		changed := events.Changed()
+		var err error
+		page.Events, page.Last, err = events.Since(after, filter.Matches)
+		if errors.Is(err, notificationservice.ErrEventsDropped) {
+			writeEventsDropped(w, page.Last)
+			return
+		}
+		if len(page.Events) > 0 || events.Closed() {
+			break
+		}
+		after = page.Last
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			break poll
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		server.Logger(r).Warn().Err(err).Msg("failed to write response")
+	}
+}
+
+// writeEventsDropped tells a long-polling client that events after its
+// position are lost and where the retained events continue.
+func writeEventsDropped(w http.ResponseWriter, last int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(EventPage{Events: []notificationservice.LoggedEvent{}, Last: last})
+}
+
+// splitList returns the comma separated items of values.
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
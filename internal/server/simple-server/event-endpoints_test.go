@@ -0,0 +1,46 @@
+package simpleserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+)
+
+func TestEventsDropped(t *testing.T) {
+	events.Notify(notificationservice.Event{Action: notificationservice.EVENT_PUSH, Repository: "app"})
+
+	// long-polls are answered with 410 and where to continue
+	w := httptest.NewRecorder()
+	handleGetEvents(w, httptest.NewRequest(http.MethodGet, "/admin/events?after=1", nil))
+	if w.Code != http.StatusGone {
+		t.Fatalf("long-poll answered %d, want %d", w.Code, http.StatusGone)
+	}
+	var page EventPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handleGetEvents(w, httptest.NewRequest(http.MethodGet, "/admin/events?wait=0s&after="+strconv.FormatInt(page.Last, 10), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("continuing from %d answered %d", page.Last, w.Code)
+	}
+
+	// streams get a reset event followed by the retained events
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/admin/events", nil).WithContext(ctx)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Last-Event-ID", "1")
+	w = httptest.NewRecorder()
+	handleGetEvents(w, r)
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "id: ") || !strings.Contains(body, "event: reset\n") || !strings.Contains(body, `"repository":"app"`) {
+		t.Errorf("stream sent %q, want a reset followed by the retained events", body)
+	}
+}
@@ -0,0 +1,67 @@
+package simpleserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// MinFreeBytes is the free disk space below which the registry reports itself
+// unready, so pushes are not accepted only to fail halfway.
+var MinFreeBytes uint64 = 100 << 20
+
+var errFreeSpaceUnsupported = errors.New("free disk space can not be determined on this platform")
+
+// handleVersionCheck answers the API version check clients send before any
+// other request. Authentication middlewares answer it with a challenge.
+func handleVersionCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
+
+// checkStorage verifies the storage directories are reachable and writable.
+func checkStorage(ctx context.Context) error {
+	for _, dir := range []string{BlobDir, ManifestDir} {
+		if _, err := os.ReadDir(dir); err != nil {
+			return err
+		}
+
+		file, err := os.CreateTemp(dir, ".healthz-*")
+		if err != nil {
+			return err
+		}
+		_, err = file.Write([]byte("ok"))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if removeErr := os.Remove(file.Name()); err == nil {
+			err = removeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFreeSpace verifies at least MinFreeBytes are left for the storage
+// directories.
+func checkFreeSpace(ctx context.Context) error {
+	for _, dir := range []string{BlobDir, ManifestDir} {
+		free, err := freeBytes(dir)
+		if errors.Is(err, errFreeSpaceUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if free < MinFreeBytes {
+			return fmt.Errorf("%s: %d MiB free, %d MiB required", dir, free>>20, MinFreeBytes>>20)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package simpleserver
+
+func freeBytes(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
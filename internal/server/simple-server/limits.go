@@ -0,0 +1,41 @@
+package simpleserver
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+var (
+	// MaxManifestSize is the largest manifest accepted. The distribution
+	// spec asks registries to accept manifests of at least 4 MiB.
+	MaxManifestSize int64 = 4 << 20
+	// MaxBlobSize is the largest blob accepted, 0 accepts blobs of any size.
+	MaxBlobSize int64
+)
+
+func isTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// isTimeout reports whether reading a request body failed because the
+// client stalled longer than the read timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeTooLarge rejects r with 413 Request Entity Too Large.
+func writeTooLarge(w http.ResponseWriter, r *http.Request, e server.OciError, limit int64) {
+	server.Logger(r).Info().Int64("limit", limit).Msg(e.Details)
+	server.WriteErrorsStatus(w, r, http.StatusRequestEntityTooLarge, e)
+}
+
+// writeTimeout rejects r with 408 Request Timeout after its body stalled.
+func writeTimeout(w http.ResponseWriter, r *http.Request, e server.OciError, err error) {
+	server.Logger(r).Info().Err(err).Msg("request body timed out")
+	server.WriteErrorsStatus(w, r, http.StatusRequestTimeout, e.WithDetails("request body timed out"))
+}
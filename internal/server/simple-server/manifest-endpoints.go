@@ -2,18 +2,25 @@ package simpleserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
 	blobservice "github.com/nilspolek/simple-reg/internal/server/blob-service"
 	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
 )
 
 var (
-	blobService     = blobservice.New()
-	manifestService = manifestservice.New()
+	events = notificationservice.NewEventLog(notificationservice.DEFAULT_EVENT_LOG_SIZE)
+	// notifier receives every event, the services send theirs to it as well
+	notifier notificationservice.Notifier = events
+
+	blobService     = blobservice.New().WithNotifier(events)
+	manifestService = manifestservice.New().WithNotifier(events).WithAccountant(usage).WithRecorder(auditRecorder{}).WithBlobs(blobLinker{})
 )
 
 func GetScheme(r *http.Request) string {
@@ -23,21 +30,78 @@ func GetScheme(r *http.Request) string {
 	return "http"
 }
 
+// SetImmutableTags configures which tags can never be moved or deleted once
+// they have been pushed.
+func SetImmutableTags(rules ...manifestservice.ImmutableTagRule) {
+	manifestService.WithImmutableTags(rules...)
+}
+
+// SetNotifiers sends the events of pushes, pulls, deletions, tag moves and
+// blob uploads to notifiers, besides the log served on /admin/events.
+func SetNotifiers(notifiers ...notificationservice.Notifier) {
+	notifier = notificationservice.Notifiers(append(notifiers, events))
+	manifestService.WithNotifier(notifier)
+	blobService.WithNotifier(notifier)
+}
+
+// SetEventLogSize sets how many events /admin/events retains for clients
+// resuming a stream.
+func SetEventLogSize(size int) {
+	events.WithSize(size)
+}
+
+// identity names the caller of r for tag history records.
+func identity(r *http.Request) string {
+	if user, ok := server.UserFromRequest(r); ok {
+		return user
+	}
+	return server.ClientIP(r)
+}
+
 func handlePutManifest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["name"]
 	ref := vars["reference"]
 
-	data, err := io.ReadAll(r.Body)
+	if r.ContentLength > MaxManifestSize {
+		writeTooLarge(w, r, server.ERROR_MANIFEST_TOO_LARGE, MaxManifestSize)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxManifestSize))
+	if isTooLarge(err) {
+		writeTooLarge(w, r, server.ERROR_MANIFEST_TOO_LARGE, MaxManifestSize)
+		return
+	}
+	if isTimeout(err) {
+		writeTimeout(w, r, server.ERROR_MANIFEST_INVALID, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		server.WriteInternalError(w, r, err)
 		return
 	}
 	defer r.Body.Close()
 
-	hash, err := manifestService.CreateManifest(data, repo, ref)
+	hash, err := manifestService.CreateManifest(r.Context(), data, repo, ref, identity(r))
+	if errors.Is(err, manifestservice.ErrDigestMismatch) {
+		server.WriteErrors(w, r, server.ERROR_DIGEST_INVALID)
+		return
+	}
+	if errors.Is(err, manifestservice.ErrBlobUnknown) {
+		server.WriteErrors(w, r, server.ERROR_MANIFEST_BLOB_UNKNOWN.WithDetails(err.Error()))
+		return
+	}
+	if errors.Is(err, manifestservice.ErrTagImmutable) {
+		server.WriteErrors(w, r, server.ERROR_DENIED)
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaExceeded(w, r, repo)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		server.WriteInternalError(w, r, err)
 		return
 	}
 
@@ -55,17 +119,29 @@ func handleGetManifest(w http.ResponseWriter, r *http.Request) {
 	repo := vars["name"]
 	ref := vars["reference"]
 
-	manifest, hash, err := manifestService.GetManifest(repo, ref)
+	manifest, hash, err := manifestService.GetManifest(r.Context(), repo, ref)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeManifestError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	w.Header().Set("Content-Type", manifestservice.MediaType(manifest))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest)))
 	w.Header().Set("Docker-Content-Digest", hash)
 	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
 	w.Write(manifest)
+
+	// HEAD only checks for the manifest, a pull fetches it
+	event := notificationservice.NewEvent(r.Context(), notificationservice.EVENT_PULL, repo)
+	event.Digest = hash
+	event.Size = int64(len(manifest))
+	if server.IsValidTag(ref) {
+		event.Tag = ref
+	}
+	notifier.Notify(event)
 }
 
 type RepoTag struct {
@@ -74,12 +150,15 @@ type RepoTag struct {
 }
 
 func handleGetAllTags(w http.ResponseWriter, r *http.Request) {
-	allTags := manifestService.GetAllTags()
+	allTags := manifestService.GetAllTags(r.Context())
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	repoTags := make([]RepoTag, 0)
 	for repo, tag := range allTags {
+		if !server.CanSeeRepository(r, repo) {
+			continue
+		}
 		repoTags = append(repoTags, RepoTag{
 			Name: repo,
 			Tags: tag,
@@ -87,8 +166,7 @@ func handleGetAllTags(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(repoTags); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		server.Logger(r).Warn().Err(err).Msg("failed to write response")
 	}
 }
 
@@ -96,7 +174,7 @@ func handleGetTags(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["name"]
 
-	tags := manifestService.GetTags(repo)
+	tags := manifestService.GetTags(r.Context(), repo)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -107,8 +185,7 @@ func handleGetTags(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(tagDTO); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		server.Logger(r).Warn().Err(err).Msg("failed to write response")
 	}
 }
 
@@ -117,10 +194,33 @@ func handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	repo := vars["name"]
 	ref := vars["reference"]
 
-	if err := manifestService.DeleteManifest(repo, ref); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	_, err := manifestService.DeleteManifest(r.Context(), repo, ref)
+	if errors.Is(err, manifestservice.ErrTagImmutable) {
+		server.WriteErrors(w, r, server.ERROR_DENIED)
+		return
+	}
+	if err != nil {
+		writeManifestError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// writeManifestError answers a failure to look up a manifest, unknown
+// repositories and references are 404s.
+func writeManifestError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, manifestservice.ErrInvalidName) {
+		server.WriteErrors(w, r, server.ERROR_NAME_INVALID)
+		return
+	}
+	if errors.Is(err, manifestservice.ErrNameUnknown) {
+		server.WriteErrors(w, r, server.ERROR_NAME_UNKNOWN)
+		return
+	}
+	if errors.Is(err, manifestservice.ErrManifestUnknown) || errors.Is(err, manifestservice.ErrInvalidRef) {
+		server.WriteErrors(w, r, server.ERROR_MANIFEST_UNKNOWN)
+		return
+	}
+	server.WriteInternalError(w, r, err)
+}
@@ -0,0 +1,135 @@
+package simpleserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nilspolek/simple-reg/internal/server"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	notificationservice "github.com/nilspolek/simple-reg/internal/server/notification-service"
+)
+
+type recordingNotifier struct {
+	sync.Mutex
+	events []notificationservice.Event
+}
+
+func (n *recordingNotifier) Notify(event notificationservice.Event) {
+	n.Lock()
+	defer n.Unlock()
+	n.events = append(n.events, event)
+}
+
+func (n *recordingNotifier) actions() []string {
+	n.Lock()
+	defer n.Unlock()
+	actions := make([]string, 0, len(n.events))
+	for _, event := range n.events {
+		actions = append(actions, event.Action)
+	}
+	return actions
+}
+
+// recordEvents records the events sent for the duration of t.
+func recordEvents(t *testing.T) *recordingNotifier {
+	t.Helper()
+	recorder := &recordingNotifier{}
+	SetNotifiers(recorder)
+	t.Cleanup(func() { SetNotifiers() })
+	return recorder
+}
+
+func TestPullEvents(t *testing.T) {
+	useTempStorage(t)
+	if status := pushManifest("app", "v1"); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+	recorder := recordEvents(t)
+
+	vars := map[string]string{"name": "app", "reference": "v1"}
+	if w := serve(handleGetManifest, http.MethodHead, "/v2/app/manifests/v1", vars, ""); w.Code != http.StatusOK {
+		t.Fatalf("HEAD answered %d", w.Code)
+	}
+	if actions := recorder.actions(); len(actions) != 0 {
+		t.Fatalf("HEAD sent %v", actions)
+	}
+
+	if w := serve(handleGetManifest, http.MethodGet, "/v2/app/manifests/v1", vars, ""); w.Code != http.StatusOK {
+		t.Fatalf("GET answered %d", w.Code)
+	}
+	recorder.Lock()
+	defer recorder.Unlock()
+	if len(recorder.events) != 1 || recorder.events[0].Action != notificationservice.EVENT_PULL || recorder.events[0].Tag != "v1" {
+		t.Fatalf("GET sent %+v, want one pull of v1", recorder.events)
+	}
+}
+
+// errorMessage returns the message of the first OCI error w answered with.
+func errorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body server.OciErrors
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || len(body.Errors) == 0 {
+		t.Fatalf("answered %d %q, want an OCI error", w.Code, w.Body.String())
+	}
+	return body.Errors[0].Message
+}
+
+func TestManifestErrors(t *testing.T) {
+	useTempStorage(t)
+	if status := pushManifest("app", "v1"); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+
+	unknown := "sha256:" + strings.Repeat("0f", 32)
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		name    string
+		ref     string
+		message string
+	}{
+		{handleGetManifest, http.MethodGet, "other", "v1", server.ERROR_NAME_UNKNOWN.Message},
+		{handleGetManifest, http.MethodGet, "app", "v2", server.ERROR_MANIFEST_UNKNOWN.Message},
+		{handleGetManifest, http.MethodGet, "app", unknown, server.ERROR_MANIFEST_UNKNOWN.Message},
+		{handleDeleteManifest, http.MethodDelete, "other", "v1", server.ERROR_NAME_UNKNOWN.Message},
+		{handleDeleteManifest, http.MethodDelete, "app", "v2", server.ERROR_MANIFEST_UNKNOWN.Message},
+		{handleDeleteManifest, http.MethodDelete, "app", unknown, server.ERROR_MANIFEST_UNKNOWN.Message},
+	}
+	for _, test := range tests {
+		vars := map[string]string{"name": test.name, "reference": test.ref}
+		w := serve(test.handler, test.method, "/v2/"+test.name+"/manifests/"+test.ref, vars, "")
+		if message := errorMessage(t, w); w.Code != http.StatusNotFound || message != test.message {
+			t.Errorf("%s %s:%s answered %d %s, want 404 %s", test.method, test.name, test.ref, w.Code, message, test.message)
+		}
+	}
+}
+
+func TestManifestContentType(t *testing.T) {
+	useTempStorage(t)
+
+	docker := "application/vnd.docker.distribution.manifest.v2+json"
+	tests := []struct {
+		manifest    string
+		contentType string
+	}{
+		{`{"schemaVersion":2,"mediaType":"` + docker + `","layers":[]}`, docker},
+		{`{"schemaVersion":2,"layers":[]}`, manifestservice.MEDIA_TYPE_OCI_MANIFEST},
+		{`{"schemaVersion":2,"manifests":[]}`, manifestservice.MEDIA_TYPE_OCI_INDEX},
+	}
+	for _, test := range tests {
+		vars := map[string]string{"name": "app", "reference": "v1"}
+		if w := serve(handlePutManifest, http.MethodPut, "/v2/app/manifests/v1", vars, test.manifest); w.Code != http.StatusCreated {
+			t.Fatalf("push of %s answered %d", test.manifest, w.Code)
+		}
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			w := serve(handleGetManifest, method, "/v2/app/manifests/v1", vars, "")
+			if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+				t.Errorf("%s of %s served %q, want %q", method, test.manifest, contentType, test.contentType)
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package simpleserver
+
+import (
+	"github.com/nilspolek/simple-reg/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var quotaExceeded = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: server.METRICS_NAMESPACE,
+	Name:      "quota_exceeded_total",
+	Help:      "Uploads and manifest pushes denied by storage quotas.",
+})
+
+func init() {
+	prometheus.MustRegister(blobService, manifestService)
+}
@@ -0,0 +1,130 @@
+package simpleserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+var (
+	usage = newStorageUsage()
+
+	errQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// Quota caps the bytes stored by a repository or, when Repository ends in
+// "/", by all repositories of that namespace together. Blobs count once per
+// quota however many manifests reference them, uploads in progress count
+// as stored.
+type Quota struct {
+	Repository string
+	Bytes      int64
+}
+
+// ParseQuota parses "<repository>=<size>" or "<namespace>/=<size>", e.g.
+// "team-a/=50GiB" or "team-a/app=5GiB".
+func ParseQuota(value string) (Quota, error) {
+	repo, size, ok := strings.Cut(value, "=")
+	if !ok {
+		return Quota{}, fmt.Errorf("invalid quota %q, expected <repository or namespace/>=<size>", value)
+	}
+	if !server.IsValidName(strings.TrimSuffix(repo, "/")) {
+		return Quota{}, fmt.Errorf("invalid quota %q: invalid repository or namespace %q", value, repo)
+	}
+
+	bytes, err := server.ParseSize(size)
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid quota %q: %w", value, err)
+	}
+	return Quota{Repository: repo, Bytes: bytes}, nil
+}
+
+func (q Quota) IsNamespace() bool {
+	return strings.HasSuffix(q.Repository, "/")
+}
+
+func (q Quota) Covers(repo string) bool {
+	if q.IsNamespace() {
+		return strings.HasPrefix(repo, q.Repository)
+	}
+	return repo == q.Repository
+}
+
+// SetQuotas replaces the storage quotas enforced on uploads and manifest
+// pushes.
+func SetQuotas(q ...Quota) {
+	usage.setQuotas(q...)
+}
+
+// quotaReader accounts every byte read to the upload session id and fails
+// with errQuotaExceeded once that exceeds a quota, reading at most one byte
+// beyond the limit.
+type quotaReader struct {
+	io.ReadCloser
+	id uuid.UUID
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if remaining, ok := usage.uploadHeadroom(r.id); ok {
+		if remaining < 0 {
+			return 0, errQuotaExceeded
+		}
+		if int64(len(p)) > remaining+1 {
+			p = p[:remaining+1]
+		}
+	}
+	n, err := r.ReadCloser.Read(p)
+	if chargeErr := usage.charge(r.id, int64(n)); chargeErr != nil {
+		return n, chargeErr
+	}
+	return n, err
+}
+
+// usageReport returns the usage of repo and of every namespace containing
+// it. When repo is empty it covers every repository and every repository or
+// namespace with a quota.
+func usageReport(repo string) UsageReport {
+	repos := map[string]bool{repo: true}
+	namespaces := make(map[string]bool)
+	if repo == "" {
+		repos = make(map[string]bool)
+		for _, name := range usage.repositories() {
+			repos[name] = true
+		}
+		for _, q := range usage.configuredQuotas() {
+			if q.IsNamespace() {
+				namespaces[q.Repository] = true
+			} else {
+				repos[q.Repository] = true
+			}
+		}
+	}
+
+	report := UsageReport{Repositories: make([]Usage, 0), Namespaces: make([]Usage, 0)}
+	for _, repo := range slices.Sorted(maps.Keys(repos)) {
+		report.Repositories = append(report.Repositories, usage.of(repo, Quota{Repository: repo}.Covers))
+		for i, c := range repo {
+			if c == '/' {
+				namespaces[repo[:i+1]] = true
+			}
+		}
+	}
+	for _, namespace := range slices.Sorted(maps.Keys(namespaces)) {
+		report.Namespaces = append(report.Namespaces, usage.of(namespace, Quota{Repository: namespace}.Covers))
+	}
+	return report
+}
+
+// writeQuotaExceeded denies r for exceeding a quota covering repo.
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request, repo string) {
+	quotaExceeded.Inc()
+	server.Logger(r).Info().Str("repository", repo).Msg("storage quota exceeded")
+	server.WriteErrors(w, r, server.ERROR_QUOTA_EXCEEDED)
+}
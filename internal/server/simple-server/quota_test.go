@@ -0,0 +1,199 @@
+package simpleserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+// useQuotas enforces q for the duration of t.
+func useQuotas(t *testing.T, q ...Quota) {
+	t.Helper()
+	SetQuotas(q...)
+	t.Cleanup(func() { SetQuotas() })
+}
+
+// serve runs handler for a request with vars and body.
+func serve(handler http.HandlerFunc, method, target string, vars map[string]string, body string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(method, target, strings.NewReader(body)), vars)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// upload uploads content to repo through the handlers and returns the
+// status of the first request failing, or of finalizing the upload.
+func upload(repo, content string) int {
+	w := serve(handleStartUpload, http.MethodPost, "/v2/"+repo+"/blobs/uploads/", map[string]string{"name": repo}, "")
+	if w.Code != http.StatusAccepted {
+		return w.Code
+	}
+
+	id := w.Header().Get("Docker-Upload-UUID")
+	vars := map[string]string{"name": repo, "id": id}
+	target := "/v2/" + repo + "/blobs/uploads/" + id
+	if w := serve(handlePatchBlob, http.MethodPatch, target, vars, content); w.Code != http.StatusAccepted {
+		return w.Code
+	}
+	return serve(handleFinalizeUpload, http.MethodPut, target+"?digest="+sha256Digest(content), vars, "").Code
+}
+
+// pushManifest pushes a manifest referencing layers to repo:tag.
+func pushManifest(repo, tag string, layers ...string) int {
+	descriptors := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		descriptors = append(descriptors, fmt.Sprintf(`{"digest":%q,"size":%d}`, sha256Digest(layer), len(layer)))
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"layers":[%s]}`, strings.Join(descriptors, ","))
+
+	vars := map[string]string{"name": repo, "reference": tag}
+	return serve(handlePutManifest, http.MethodPut, "/v2/"+repo+"/manifests/"+tag, vars, manifest).Code
+}
+
+func TestQuotaCountsUnreferencedUploads(t *testing.T) {
+	useTempStorage(t)
+	useQuotas(t, Quota{Repository: "team/", Bytes: 25})
+
+	layer := strings.Repeat("a", 10)
+	if status := upload("team/app", layer); status != http.StatusCreated {
+		t.Fatalf("first upload answered %d", status)
+	}
+	if status := upload("team/app", strings.Repeat("b", 10)); status != http.StatusCreated {
+		t.Fatalf("second upload answered %d", status)
+	}
+	// never pushing a manifest must not reset the usage
+	if status := upload("team/other", strings.Repeat("c", 10)); status != http.StatusForbidden {
+		t.Fatalf("upload over quota answered %d, want %d", status, http.StatusForbidden)
+	}
+	if status := upload("team/other", strings.Repeat("d", 6)); status != http.StatusForbidden {
+		t.Fatalf("upload beyond the remaining quota answered %d, want %d", status, http.StatusForbidden)
+	}
+	if status := upload("elsewhere", strings.Repeat("c", 10)); status != http.StatusCreated {
+		t.Fatalf("upload outside quota answered %d", status)
+	}
+
+	if got := usage.of("team/", Quota{Repository: "team/"}.Covers).Bytes; got != 20 {
+		t.Errorf("namespace uses %d bytes, want 20", got)
+	}
+
+	// garbage collection frees the quota again
+	usage.removeBlobs(sha256Digest(strings.Repeat("b", 10)))
+	if got := usage.of("team/", Quota{Repository: "team/"}.Covers).Bytes; got != 10 {
+		t.Errorf("namespace uses %d bytes after garbage collection, want 10", got)
+	}
+}
+
+func TestQuotaManifestPush(t *testing.T) {
+	useTempStorage(t)
+	useQuotas(t, Quota{Repository: "app", Bytes: 300})
+
+	layer := strings.Repeat("a", 100)
+	if status := upload("app", layer); status != http.StatusCreated {
+		t.Fatalf("upload answered %d", status)
+	}
+	// the layer counts already, the push only adds the manifest
+	if status := pushManifest("app", "v1", layer); status != http.StatusCreated {
+		t.Fatalf("push answered %d", status)
+	}
+	before := usage.of("app", Quota{Repository: "app"}.Covers).Bytes
+
+	// a blob uploaded to another repository cannot be referenced
+	other := strings.Repeat("b", 250)
+	if status := upload("elsewhere", other); status != http.StatusCreated {
+		t.Fatalf("upload answered %d", status)
+	}
+	if status := pushManifest("app", "v2", layer, other); status != http.StatusBadRequest {
+		t.Fatalf("push referencing a foreign blob answered %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// a new manifest does not fit anymore
+	useQuotas(t, Quota{Repository: "app", Bytes: before})
+	if status := pushManifest("app", "v2", layer, layer); status != http.StatusForbidden {
+		t.Fatalf("push over quota answered %d, want %d", status, http.StatusForbidden)
+	}
+	if got := usage.of("app", Quota{Repository: "app"}.Covers).Bytes; got != before {
+		t.Errorf("denied push changed usage from %d to %d", before, got)
+	}
+
+	// moving a tag adds nothing and passes
+	if status := pushManifest("app", "latest", layer); status != http.StatusCreated {
+		t.Fatalf("tag move answered %d", status)
+	}
+
+	// the accounted usage matches the storage
+	accounted := usage.of("app", Quota{Repository: "app"}.Covers).Bytes
+	if err := usage.load(); err != nil {
+		t.Fatal(err)
+	}
+	if stored := usage.of("app", Quota{Repository: "app"}.Covers).Bytes; stored != accounted {
+		t.Errorf("accounted %d bytes, storage holds %d", accounted, stored)
+	}
+}
+
+func TestQuotaChunkedUpload(t *testing.T) {
+	useTempStorage(t)
+	useQuotas(t, Quota{Repository: "app", Bytes: 10})
+
+	w := serve(handleStartUpload, http.MethodPost, "/v2/app/blobs/uploads/", map[string]string{"name": "app"}, "")
+	id := w.Header().Get("Docker-Upload-UUID")
+	vars := map[string]string{"name": "app", "id": id}
+
+	// a chunked request announces no length and is cut off while writing
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodPatch, "/v2/app/blobs/uploads/"+id, strings.NewReader(strings.Repeat("a", 20))), vars)
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	handlePatchBlob(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("chunk over quota answered %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if got := usage.of("app", Quota{Repository: "app"}.Covers).Uploading; got > 11 {
+		t.Errorf("read %d bytes, at most one beyond the quota", got)
+	}
+}
+
+func TestQuotaCancelledAndExpiredUploads(t *testing.T) {
+	useTempStorage(t)
+	useQuotas(t, Quota{Repository: "app", Bytes: 10})
+	expiry := UploadExpiry
+	t.Cleanup(func() { UploadExpiry = expiry })
+
+	patch := func(content string) string {
+		t.Helper()
+		id := serve(handleStartUpload, http.MethodPost, "/v2/app/blobs/uploads/", map[string]string{"name": "app"}, "").Header().Get("Docker-Upload-UUID")
+		vars := map[string]string{"name": "app", "id": id}
+		if w := serve(handlePatchBlob, http.MethodPatch, "/v2/app/blobs/uploads/"+id, vars, content); w.Code != http.StatusAccepted {
+			t.Fatalf("patch answered %d", w.Code)
+		}
+		return id
+	}
+	uploading := func() int64 {
+		return usage.of("app", Quota{Repository: "app"}.Covers).Uploading
+	}
+
+	id := patch(strings.Repeat("a", 10))
+	vars := map[string]string{"name": "app", "id": id}
+	if w := serve(handleCancelUpload, http.MethodDelete, "/v2/app/blobs/uploads/"+id, vars, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("cancel answered %d", w.Code)
+	}
+	if got := uploading(); got != 0 {
+		t.Errorf("cancelled upload still counts %d bytes", got)
+	}
+	if w := serve(handleCancelUpload, http.MethodDelete, "/v2/app/blobs/uploads/"+id, vars, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second cancel answered %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	patch(strings.Repeat("b", 10))
+	UploadExpiry = 0
+	expireUploads(zerolog.Nop())
+	if got := uploading(); got != 0 {
+		t.Errorf("expired upload still counts %d bytes", got)
+	}
+	if status := upload("app", strings.Repeat("c", 10)); status != http.StatusCreated {
+		t.Errorf("upload after expiry answered %d", status)
+	}
+}
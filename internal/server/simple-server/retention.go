@@ -0,0 +1,91 @@
+package simpleserver
+
+import (
+	"context"
+	"time"
+
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	"github.com/rs/zerolog"
+)
+
+// BlobGracePeriod protects freshly uploaded blobs from garbage collection
+// until the manifest referencing them had time to be pushed.
+var BlobGracePeriod = time.Hour
+
+// UploadExpiry is how long an upload session may go without a chunk before
+// it is cancelled.
+var UploadExpiry = 24 * time.Hour
+
+// RunUploadExpiry cancels upload sessions idle for longer than UploadExpiry
+// every interval until ctx is done.
+func RunUploadExpiry(ctx context.Context, interval time.Duration, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expireUploads(logger)
+		}
+	}
+}
+
+func expireUploads(logger zerolog.Logger) {
+	expired, err := blobService.ExpireUploads(UploadExpiry)
+	for _, id := range expired {
+		usage.endUpload(id, "")
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to expire uploads")
+	}
+	if len(expired) > 0 {
+		logger.Info().Int("expired uploads", len(expired)).Msg("upload sessions expired")
+	}
+}
+
+// RunRetention applies the retention policies and garbage collects
+// unreferenced blobs every interval until ctx is done.
+func RunRetention(ctx context.Context, interval time.Duration, logger zerolog.Logger, policies ...manifestservice.RetentionPolicy) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runRetention(logger, policies...)
+		}
+	}
+}
+
+func runRetention(logger zerolog.Logger, policies ...manifestservice.RetentionPolicy) {
+	expired, err := manifestService.ApplyRetention(logger.WithContext(context.Background()), time.Now(), policies...)
+	for _, tag := range expired {
+		logger.Info().
+			Str("repository", tag.Repository).
+			Str("tag", tag.Tag).
+			Str("digest", tag.Digest).
+			Msg("tag expired")
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to apply retention policies")
+		return
+	}
+
+	var deleted []string
+	err = manifestService.CollectGarbage(func(referenced map[string]bool) (err error) {
+		deleted, err = blobService.GarbageCollect(referenced, BlobGracePeriod)
+		return err
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to garbage collect blobs")
+	}
+	usage.removeBlobs(deleted...)
+	logger.Info().
+		Int("expired tags", len(expired)).
+		Int("deleted blobs", len(deleted)).
+		Msg("retention run finished")
+}
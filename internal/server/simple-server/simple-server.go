@@ -1,11 +1,15 @@
 package simpleserver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 
 	"github.com/nilspolek/simple-reg/internal/server"
+	blobservice "github.com/nilspolek/simple-reg/internal/server/blob-service"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+	"go.opentelemetry.io/otel"
 )
 
 const (
@@ -14,6 +18,8 @@ const (
 )
 
 var (
+	tracer = otel.Tracer("github.com/nilspolek/simple-reg/internal/server/simple-server")
+
 	BlobDir     = "./data/blobs"
 	ManifestDir = "./data/manifests"
 )
@@ -22,8 +28,17 @@ func New(blobdir ...string) *server.Server {
 	if len(blobdir) > 0 {
 		BlobDir = blobdir[0]
 	}
+	blobservice.BlobDir = BlobDir
+	manifestservice.ManifestDir = ManifestDir
+
 	svr := server.NewServer()
 	setupRoutes(svr)
+	svr.WithShutdownHook(func(context.Context) error {
+		return blobService.Close()
+	})
+	svr.WithDrainHook(events.Close)
+	svr.WithHealthCheck("storage", checkStorage)
+	svr.WithHealthCheck("disk", checkFreeSpace)
 
 	// create blobdir if it doesn't exist
 	if _, err := os.Stat(BlobDir); os.IsNotExist(err) {
@@ -37,35 +52,70 @@ func New(blobdir ...string) *server.Server {
 			panic(err)
 		}
 	}
+
+	if err := manifestService.MigrateLegacyLayout(); err != nil {
+		svr.GetLogger().Error().Err(err).Msg("failed to migrate legacy manifest layout")
+	}
+	if err := blobService.MigrateLinks(referencedByRepository); err != nil {
+		svr.GetLogger().Error().Err(err).Msg("failed to link blobs to repositories")
+	}
+	if err := usage.load(); err != nil {
+		svr.GetLogger().Error().Err(err).Msg("failed to load storage usage")
+	}
 	return svr
 }
 
 func setupRoutes(svr *server.Server) {
 
 	svr.Router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		svr.GetLogger().Debug().Msg(fmt.Sprintf("method not found %s [%s]", r.Method, r.URL.Path))
-		http.Error(w, "Not Found", http.StatusNotFound)
+		server.Logger(r).Debug().Msg(fmt.Sprintf("method not found %s [%s]", r.Method, r.URL.Path))
+		server.WriteErrorsStatus(w, r, http.StatusNotFound, server.ERROR_UNSUPPORTED.WithDetails("no such endpoint"))
 	})
 
 	svr.Router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		svr.GetLogger().Debug().Msg(fmt.Sprintf("method not allowed %s [%s]", r.Method, r.URL.Path))
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		server.Logger(r).Debug().Msg(fmt.Sprintf("method not allowed %s [%s]", r.Method, r.URL.Path))
+		server.WriteErrors(w, r, server.ERROR_UNSUPPORTED)
 	})
 
 	prefix := fmt.Sprintf("/v%d", VERSION)
-	svr.WithHandlerFunc(prefix+"/", handleGetAllTags, "GET")
-	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/", handleStartUpload, http.MethodPost)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/{id}", handleFinalizeUpload, http.MethodPut)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/{id}", handlePatchBlob, http.MethodPatch)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/{digest}", handleBlobHeaders, http.MethodGet, http.MethodHead)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/{digest}", handleGetBlob, http.MethodGet)
+	svr.WithHandlerFunc(prefix+"/", handleVersionCheck, http.MethodGet, http.MethodHead)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/", validated(handleStartUpload), http.MethodPost)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/{id}", validated(handleFinalizeUpload), http.MethodPut)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/{id}", validated(handlePatchBlob), http.MethodPatch)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/uploads/{id}", validated(handleCancelUpload), http.MethodDelete)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/{digest}", validated(handleBlobHeaders), http.MethodHead)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/blobs/{digest}", validated(handleGetBlob), http.MethodGet)
 
 	// manifest
-	svr.WithHandlerFunc(prefix+"/{name:.+}/manifests/{reference:.+}", handleGetManifest, http.MethodGet, http.MethodHead)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/manifests/{reference:.+}", handlePutManifest, http.MethodPut)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/manifests/{reference:.+}", handleDeleteManifest, http.MethodDelete)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/manifests/{reference:.+}", validated(handleGetManifest), http.MethodGet, http.MethodHead)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/manifests/{reference:.+}", validated(handlePutManifest), http.MethodPut)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/manifests/{reference:.+}", validated(handleDeleteManifest), http.MethodDelete)
 
 	// tag
 	svr.WithHandlerFunc(prefix+"/tags/list", handleGetAllTags, http.MethodGet)
-	svr.WithHandlerFunc(prefix+"/{name:.+}/tags/list", handleGetTags, http.MethodGet)
+	svr.WithHandlerFunc(prefix+"/{name:.+}/tags/list", validated(handleGetTags), http.MethodGet)
+
+	// admin
+	svr.WithHandlerFunc("/admin/{name:.+}/tags/{tag}/history", validated(handleGetTagHistory), http.MethodGet)
+	svr.WithHandlerFunc("/admin/{name:.+}/tags/{tag}/rollback", validated(handleRollbackTag), http.MethodPost)
+	svr.WithHandlerFunc("/admin/usage", handleGetUsage, http.MethodGet)
+	svr.WithHandlerFunc("/admin/events", handleGetEvents, http.MethodGet)
+	svr.WithHandlerFunc("/admin/{name:.+}/usage", validated(handleGetRepositoryUsage), http.MethodGet)
+}
+
+// referencedByRepository returns the digests the manifests of every
+// repository reference.
+func referencedByRepository() (map[string][]string, error) {
+	contents, err := manifestService.Contents(func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string][]string, len(contents))
+	for repo, content := range contents {
+		for _, manifest := range content.Manifests {
+			referenced[repo] = append(referenced[repo], manifest.References...)
+		}
+	}
+	return referenced, nil
 }
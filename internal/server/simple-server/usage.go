@@ -0,0 +1,459 @@
+package simpleserver
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	manifestservice "github.com/nilspolek/simple-reg/internal/server/manifest-service"
+)
+
+// storageUsage keeps track of the bytes every repository stores, so quotas
+// are checked and updated in memory instead of reading the storage on every
+// request. The manifest service reports manifests to it, the handlers
+// report uploads and garbage collection.
+//
+// A finalized blob counts for the repository it was uploaded to until a
+// manifest of any repository references it or it is garbage collected.
+// Which repository unreferenced blobs were uploaded to is not known after a
+// restart.
+type storageUsage struct {
+	sync.Mutex
+	// manifests holds the manifests of every repository by digest
+	manifests map[string]map[string]manifestservice.StoredManifest
+	// references counts the manifests of all repositories referencing a
+	// digest
+	references map[string]int
+	// sizes holds the size of every referenced blob
+	sizes        map[string]int64
+	unreferenced map[string]*unreferencedBlob
+	sessions     map[uuid.UUID]*uploadSession
+	// configured holds the quotas as set, quotas their usage
+	configured []Quota
+	quotas     []*quotaUsage
+}
+
+type unreferencedBlob struct {
+	size  int64
+	repos map[string]bool
+}
+
+type uploadSession struct {
+	repo  string
+	bytes int64
+}
+
+// quotaUsage is what the repositories covered by a quota store. Blobs
+// referenced by several of them count once.
+type quotaUsage struct {
+	Quota
+	manifests         int64
+	blobs             map[string]int
+	blobBytes         int64
+	unreferenced      map[string]bool
+	unreferencedBytes int64
+	uploading         int64
+}
+
+func (q *quotaUsage) used() int64 {
+	return q.manifests + q.blobBytes + q.unreferencedBytes + q.uploading
+}
+
+func newStorageUsage() *storageUsage {
+	u := &storageUsage{}
+	u.reset()
+	return u
+}
+
+func (u *storageUsage) reset() {
+	u.manifests = make(map[string]map[string]manifestservice.StoredManifest)
+	u.references = make(map[string]int)
+	u.sizes = make(map[string]int64)
+	u.unreferenced = make(map[string]*unreferencedBlob)
+	u.sessions = make(map[uuid.UUID]*uploadSession)
+	u.rebuildQuotas()
+}
+
+// load reads the manifests of every repository from the storage, forgetting
+// everything accounted so far.
+func (u *storageUsage) load() error {
+	contents, err := manifestService.Contents(func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+
+	sizes := make(map[string]int64)
+	for _, repoContents := range contents {
+		for _, manifest := range repoContents.Manifests {
+			for _, digest := range manifest.References {
+				if _, ok := sizes[digest]; !ok {
+					sizes[digest] = blobSize(digest)
+				}
+			}
+		}
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	u.reset()
+	u.sizes = sizes
+	for repo, repoContents := range contents {
+		u.manifests[repo] = repoContents.Manifests
+		for _, manifest := range repoContents.Manifests {
+			for _, digest := range manifest.References {
+				u.references[digest]++
+			}
+		}
+	}
+	u.rebuildQuotas()
+	return nil
+}
+
+// blobSize returns the size of the stored blob digest. References to other
+// manifests have no blob and count as 0.
+func blobSize(digest string) int64 {
+	size, _ := blobService.Size(digest)
+	return size
+}
+
+func (u *storageUsage) setQuotas(q ...Quota) {
+	u.Lock()
+	defer u.Unlock()
+	u.configured = q
+	u.rebuildQuotas()
+}
+
+// configuredQuotas returns the quotas as set.
+func (u *storageUsage) configuredQuotas() []Quota {
+	u.Lock()
+	defer u.Unlock()
+	return slices.Clone(u.configured)
+}
+
+// quotaOf returns the quota configured for exactly the repository or
+// namespace name, or 0. The caller has to hold the lock.
+func (u *storageUsage) quotaOf(name string) int64 {
+	for _, q := range u.configured {
+		if q.Repository == name {
+			return q.Bytes
+		}
+	}
+	return 0
+}
+
+// rebuildQuotas computes the usage of every quota from scratch.
+func (u *storageUsage) rebuildQuotas() {
+	u.quotas = make([]*quotaUsage, 0, len(u.configured))
+	for _, quota := range u.configured {
+		q := &quotaUsage{Quota: quota, blobs: make(map[string]int), unreferenced: make(map[string]bool)}
+		for repo, manifests := range u.manifests {
+			if !q.Covers(repo) {
+				continue
+			}
+			for _, manifest := range manifests {
+				u.addManifest(q, manifest)
+			}
+		}
+		for digest, blob := range u.unreferenced {
+			if slices.ContainsFunc(slices.Collect(maps.Keys(blob.repos)), q.Covers) {
+				q.unreferenced[digest] = true
+				q.unreferencedBytes += blob.size
+			}
+		}
+		for _, session := range u.sessions {
+			if q.Covers(session.repo) {
+				q.uploading += session.bytes
+			}
+		}
+		u.quotas = append(u.quotas, q)
+	}
+}
+
+func (u *storageUsage) covering(repo string) []*quotaUsage {
+	covering := make([]*quotaUsage, 0)
+	for _, q := range u.quotas {
+		if q.Covers(repo) {
+			covering = append(covering, q)
+		}
+	}
+	return covering
+}
+
+func (u *storageUsage) addManifest(q *quotaUsage, manifest manifestservice.StoredManifest) {
+	q.manifests += manifest.Size
+	for _, digest := range manifest.References {
+		if q.blobs[digest] == 0 {
+			q.blobBytes += u.sizes[digest]
+		}
+		q.blobs[digest]++
+	}
+}
+
+// StoreManifest accounts manifest to repo unless that exceeds a quota.
+// Manifests adding no bytes, e.g. because every blob they reference is
+// already counted, pass even over quota.
+func (u *storageUsage) StoreManifest(repo, digest string, manifest manifestservice.StoredManifest) error {
+	sizes := make(map[string]int64)
+	for _, ref := range manifest.References {
+		sizes[ref] = blobSize(ref)
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	if _, ok := u.manifests[repo][digest]; ok {
+		return nil
+	}
+	for ref, size := range sizes {
+		if _, ok := u.sizes[ref]; !ok {
+			u.sizes[ref] = size
+		}
+	}
+
+	covering := u.covering(repo)
+	for _, q := range covering {
+		added := manifest.Size
+		for _, ref := range manifest.References {
+			if q.blobs[ref] == 0 {
+				added += u.sizes[ref]
+			}
+			if q.unreferenced[ref] {
+				added -= u.unreferenced[ref].size
+			}
+		}
+		if added > 0 && q.used()+added > q.Bytes {
+			return errQuotaExceeded
+		}
+	}
+
+	if u.manifests[repo] == nil {
+		u.manifests[repo] = make(map[string]manifestservice.StoredManifest)
+	}
+	u.manifests[repo][digest] = manifest
+	for _, ref := range manifest.References {
+		u.references[ref]++
+		u.forgetUnreferenced(ref)
+	}
+	for _, q := range covering {
+		u.addManifest(q, manifest)
+	}
+	return nil
+}
+
+func (u *storageUsage) RemoveManifest(repo, digest string) {
+	u.Lock()
+	defer u.Unlock()
+
+	manifest, ok := u.manifests[repo][digest]
+	if !ok {
+		return
+	}
+	delete(u.manifests[repo], digest)
+	if len(u.manifests[repo]) == 0 {
+		delete(u.manifests, repo)
+	}
+
+	for _, q := range u.covering(repo) {
+		q.manifests -= manifest.Size
+		for _, ref := range manifest.References {
+			if q.blobs[ref]--; q.blobs[ref] == 0 {
+				delete(q.blobs, ref)
+				q.blobBytes -= u.sizes[ref]
+			}
+		}
+	}
+	for _, ref := range manifest.References {
+		if u.references[ref]--; u.references[ref] == 0 {
+			delete(u.references, ref)
+		}
+	}
+}
+
+// forgetUnreferenced stops counting the blob digest as unreferenced.
+func (u *storageUsage) forgetUnreferenced(digest string) {
+	blob, ok := u.unreferenced[digest]
+	if !ok {
+		return
+	}
+	delete(u.unreferenced, digest)
+	for _, q := range u.quotas {
+		if q.unreferenced[digest] {
+			delete(q.unreferenced, digest)
+			q.unreferencedBytes -= blob.size
+		}
+	}
+}
+
+// headroom returns how many bytes repo may still store, and false if no
+// quota covers it.
+func (u *storageUsage) headroom(repo string) (int64, bool) {
+	u.Lock()
+	defer u.Unlock()
+	return u.headroomLocked(repo)
+}
+
+func (u *storageUsage) headroomLocked(repo string) (int64, bool) {
+	covering := u.covering(repo)
+	if len(covering) == 0 {
+		return 0, false
+	}
+
+	remaining := covering[0].Bytes - covering[0].used()
+	for _, q := range covering[1:] {
+		remaining = min(remaining, q.Bytes-q.used())
+	}
+	return remaining, true
+}
+
+// startUpload accounts the upload session id to repo unless a quota
+// covering repo is used up.
+func (u *storageUsage) startUpload(id uuid.UUID, repo string) error {
+	u.Lock()
+	defer u.Unlock()
+
+	if remaining, ok := u.headroomLocked(repo); ok && remaining <= 0 {
+		return errQuotaExceeded
+	}
+	u.sessions[id] = &uploadSession{repo: repo}
+	return nil
+}
+
+// uploadHeadroom returns how many bytes the upload session id may still
+// write, and false if no quota covers its repository.
+func (u *storageUsage) uploadHeadroom(id uuid.UUID) (int64, bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	session, ok := u.sessions[id]
+	if !ok {
+		return 0, false
+	}
+	return u.headroomLocked(session.repo)
+}
+
+// charge accounts n bytes written to the upload session id. The bytes are
+// written already, so they are counted even when they exceed a quota,
+// which is reported as errQuotaExceeded.
+func (u *storageUsage) charge(id uuid.UUID, n int64) error {
+	u.Lock()
+	defer u.Unlock()
+
+	session, ok := u.sessions[id]
+	if !ok {
+		return nil
+	}
+	session.bytes += n
+
+	var err error
+	for _, q := range u.covering(session.repo) {
+		q.uploading += n
+		if q.used() > q.Bytes {
+			err = errQuotaExceeded
+		}
+	}
+	return err
+}
+
+// endUpload stops accounting the upload session id. When it stored the
+// blob digest, the blob counts for the repository of the session until a
+// manifest references it.
+func (u *storageUsage) endUpload(id uuid.UUID, digest string) {
+	size := int64(0)
+	if digest != "" {
+		size = blobSize(digest)
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	session, ok := u.sessions[id]
+	if !ok {
+		return
+	}
+	delete(u.sessions, id)
+	for _, q := range u.covering(session.repo) {
+		q.uploading -= session.bytes
+	}
+
+	if digest == "" || u.references[digest] > 0 {
+		return
+	}
+	blob, ok := u.unreferenced[digest]
+	if !ok {
+		blob = &unreferencedBlob{size: size, repos: make(map[string]bool)}
+		u.unreferenced[digest] = blob
+	}
+	blob.repos[session.repo] = true
+	for _, q := range u.covering(session.repo) {
+		if !q.unreferenced[digest] {
+			q.unreferenced[digest] = true
+			q.unreferencedBytes += blob.size
+		}
+	}
+}
+
+// removeBlobs stops counting the garbage collected blobs digests.
+func (u *storageUsage) removeBlobs(digests ...string) {
+	u.Lock()
+	defer u.Unlock()
+
+	for _, digest := range digests {
+		u.forgetUnreferenced(digest)
+		if u.references[digest] == 0 {
+			delete(u.sizes, digest)
+		}
+	}
+}
+
+// of returns what the repositories include returns true for store.
+func (u *storageUsage) of(name string, include func(repo string) bool) Usage {
+	u.Lock()
+	defer u.Unlock()
+
+	result := Usage{Name: name, Quota: u.quotaOf(name)}
+	blobs := make(map[string]int64)
+	for repo, manifests := range u.manifests {
+		if !include(repo) {
+			continue
+		}
+		for _, manifest := range manifests {
+			result.Bytes += manifest.Size
+			for _, ref := range manifest.References {
+				blobs[ref] = u.sizes[ref]
+			}
+		}
+	}
+	for digest, blob := range u.unreferenced {
+		if slices.ContainsFunc(slices.Collect(maps.Keys(blob.repos)), include) {
+			blobs[digest] = blob.size
+		}
+	}
+	for _, size := range blobs {
+		result.Bytes += size
+	}
+
+	for _, session := range u.sessions {
+		if include(session.repo) {
+			result.Uploading += session.bytes
+		}
+	}
+	return result
+}
+
+// repositories returns every repository storing something.
+func (u *storageUsage) repositories() []string {
+	u.Lock()
+	defer u.Unlock()
+
+	repos := make(map[string]bool)
+	for repo := range u.manifests {
+		repos[repo] = true
+	}
+	for _, blob := range u.unreferenced {
+		maps.Copy(repos, blob.repos)
+	}
+	for _, session := range u.sessions {
+		repos[session.repo] = true
+	}
+	return slices.Sorted(maps.Keys(repos))
+}
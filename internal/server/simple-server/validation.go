@@ -0,0 +1,52 @@
+package simpleserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// validated rejects requests whose route variables do not follow the OCI
+// grammar before they reach the handler, so no handler ever joins
+// unchecked user input into a filesystem path.
+func validated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		if name, ok := vars["name"]; ok && !server.IsValidName(name) {
+			server.WriteErrors(w, r, server.ERROR_NAME_INVALID)
+			return
+		}
+
+		if ref, ok := vars["reference"]; ok && !server.IsValidReference(ref) {
+			if strings.Contains(ref, ":") {
+				server.WriteErrors(w, r, server.ERROR_DIGEST_INVALID)
+				return
+			}
+			server.WriteErrors(w, r, server.ERROR_TAG_INVALID)
+			return
+		}
+
+		if tag, ok := vars["tag"]; ok && !server.IsValidTag(tag) {
+			server.WriteErrors(w, r, server.ERROR_TAG_INVALID)
+			return
+		}
+
+		if digest, ok := vars["digest"]; ok && !server.IsValidDigest(digest) {
+			server.WriteErrors(w, r, server.ERROR_DIGEST_INVALID)
+			return
+		}
+
+		if id, ok := vars["id"]; ok {
+			if _, err := uuid.Parse(id); err != nil {
+				server.WriteErrors(w, r, server.ERROR_BLOB_UPLOAD_UNKNOWN)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
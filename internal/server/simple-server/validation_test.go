@@ -0,0 +1,91 @@
+package simpleserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/nilspolek/simple-reg/internal/server"
+)
+
+// validatedStatus runs vars through validated and returns the error code it
+// answered with, or "" if the handler was reached.
+func validatedStatus(t *testing.T, vars map[string]string) string {
+	t.Helper()
+
+	reached := false
+	handler := validated(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v2/", nil), vars)
+	handler(w, r)
+	if reached {
+		return ""
+	}
+
+	var body struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || len(body.Errors) == 0 {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	return body.Errors[0].Code
+}
+
+func TestValidated(t *testing.T) {
+	hex := strings.Repeat("0f", 32)
+	tests := []struct {
+		vars map[string]string
+		code string
+	}{
+		{map[string]string{"name": "library/alpine", "reference": "latest"}, ""},
+		{map[string]string{"name": "library/alpine", "reference": hex}, ""},
+		{map[string]string{"name": "library/alpine", "reference": "sha256:" + hex}, ""},
+		{map[string]string{"name": "..", "reference": "latest"}, server.ERROR_NAME_INVALID.Code},
+		{map[string]string{"name": "../../etc", "reference": "latest"}, server.ERROR_NAME_INVALID.Code},
+		{map[string]string{"name": "%2e%2e/%2e%2e", "reference": "latest"}, server.ERROR_NAME_INVALID.Code},
+		{map[string]string{"name": "/etc/passwd", "reference": "latest"}, server.ERROR_NAME_INVALID.Code},
+		{map[string]string{"name": "library/alpine", "reference": ".."}, server.ERROR_TAG_INVALID.Code},
+		{map[string]string{"name": "library/alpine", "reference": "../../../x"}, server.ERROR_TAG_INVALID.Code},
+		{map[string]string{"name": "library/alpine", "reference": "sha256:../../x"}, server.ERROR_DIGEST_INVALID.Code},
+		{map[string]string{"name": "library/alpine", "tag": "%2e%2e"}, server.ERROR_TAG_INVALID.Code},
+		{map[string]string{"name": "library/alpine", "digest": "sha256:" + hex[:10]}, server.ERROR_DIGEST_INVALID.Code},
+		{map[string]string{"name": "library/alpine", "id": "../x"}, server.ERROR_BLOB_UPLOAD_UNKNOWN.Code},
+	}
+	for _, test := range tests {
+		if code := validatedStatus(t, test.vars); code != test.code {
+			t.Errorf("validated(%v) answered %q, want %q", test.vars, code, test.code)
+		}
+	}
+}
+
+func FuzzValidated(f *testing.F) {
+	f.Add("library/alpine", "latest")
+	f.Add("..", "latest")
+	f.Add("a", "../../etc/passwd")
+	f.Add("%2e%2e", "sha256:..")
+
+	base := f.TempDir()
+	f.Fuzz(func(t *testing.T, name, reference string) {
+		if validatedStatus(t, map[string]string{"name": name, "reference": reference}) != "" {
+			return
+		}
+		for _, path := range []string{
+			filepath.Join(base, name),
+			filepath.Join(base, name, "_tags", reference),
+			filepath.Join(base, name, "_digests", strings.TrimPrefix(reference, "sha256:")),
+		} {
+			if !server.IsWithinDir(base, path) {
+				t.Fatalf("name %q and reference %q reach %q outside %q", name, reference, path, base)
+			}
+		}
+	})
+}
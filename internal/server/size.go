@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// ParseSize parses a number of bytes with an optional decimal (KB, MB, GB,
+// TB) or binary (KiB, MiB, GiB, TiB) unit, e.g. "512MiB" or "10GB".
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	index := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if index < 0 {
+		index = len(value)
+	}
+
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(value[index:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", value, value[index:])
+	}
+	n, err := strconv.ParseFloat(value[:index], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(unit)), nil
+}
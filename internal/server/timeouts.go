@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_READ_HEADER_TIMEOUT = 10 * time.Second
+	DEFAULT_READ_TIMEOUT        = time.Minute
+	DEFAULT_WRITE_TIMEOUT       = time.Minute
+	DEFAULT_IDLE_TIMEOUT        = 2 * time.Minute
+)
+
+// Timeouts protect the server from clients holding connections without
+// making progress, e.g. slowloris attacks. Read and Write bound the pauses
+// of a transfer rather than its total duration, so layers of any size can
+// be pushed and pulled as long as data keeps flowing. 0 disables a timeout.
+type Timeouts struct {
+	// ReadHeader bounds reading the request line and headers.
+	ReadHeader time.Duration
+	// Read bounds every read of a request body.
+	Read time.Duration
+	// Write bounds every write of a response.
+	Write time.Duration
+	// Idle bounds how long a keep-alive connection waits for the next
+	// request.
+	Idle time.Duration
+}
+
+func (s *Server) WithTimeouts(timeouts Timeouts) *Server {
+	s.timeouts = timeouts
+	return s
+}
+
+// withDeadlines sets the read and write deadlines of the connection of r
+// and moves them forward whenever the body is read or the response is
+// written.
+func (s *Server) withDeadlines(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	rc := http.NewResponseController(w)
+
+	if s.timeouts.Write > 0 {
+		// the last request on the connection may have left a deadline behind
+		rc.SetWriteDeadline(time.Now().Add(s.timeouts.Write))
+		w = &deadlineWriter{ResponseWriter: w, rc: rc, timeout: s.timeouts.Write}
+	}
+
+	// requests without body get no read deadline, as an expiring deadline
+	// cancels the request context while a response is still streamed
+	if s.timeouts.Read > 0 && r.Body != nil && r.Body != http.NoBody {
+		rc.SetReadDeadline(time.Now().Add(s.timeouts.Read))
+		r.Body = &deadlineReader{ReadCloser: r.Body, rc: rc, timeout: s.timeouts.Read}
+	}
+	return w, r
+}
+
+type deadlineReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (dr *deadlineReader) Read(b []byte) (int, error) {
+	dr.rc.SetReadDeadline(time.Now().Add(dr.timeout))
+	n, err := dr.ReadCloser.Read(b)
+	if errors.Is(err, io.EOF) {
+		// handlers may take a while after reading the body, e.g. to hash
+		// an upload, which must not cancel the request
+		dr.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	return dw.ResponseWriter.Write(b)
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	dw.rc.Flush()
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TLS_RELOAD_INTERVAL is how often the certificate files are checked for
+	// changes.
+	TLS_RELOAD_INTERVAL = 5 * time.Second
+)
+
+type TLSOptions struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   uint16
+	CipherSuites []uint16
+	// ClientCAFile enables mutual TLS, client certificates are verified
+	// against the CA bundle in this file.
+	ClientCAFile string
+	// RequireClientCert rejects connections without a valid client
+	// certificate instead of falling back to other authentication.
+	RequireClientCert bool
+}
+
+// ParseTLSVersion parses "1.0" up to "1.3".
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names such
+// as "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Only secure suites are
+// accepted. The suites only apply up to TLS 1.2, TLS 1.3 suites are fixed.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				suites = append(suites, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+	}
+	return suites, nil
+}
+
+// certReloader serves the certificate found in the certificate files and
+// reloads it once they change, so certificates can be rotated without a
+// restart.
+type certReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+	log       func(error)
+}
+
+func newCertReloader(certFile, keyFile string, log func(error)) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *certReloader) lastModified() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate files. The caller has to hold the lock.
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.checkedAt) < TLS_RELOAD_INTERVAL {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+
+	// keep serving the old certificate while the files are half written
+	if modTime, err := c.lastModified(); err == nil && modTime.After(c.modTime) {
+		if err := c.reload(); err != nil {
+			c.log(err)
+		}
+	}
+	return c.cert, nil
+}
+
+func (s *Server) WithTLS(options TLSOptions) *Server {
+	s.tlsOptions = &options
+	return s
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(s.tlsOptions.CertFile, s.tlsOptions.KeyFile, func(err error) {
+		s.log.Error().Err(err).Msg("failed to reload certificate")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := s.tlsOptions.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   s.tlsOptions.CipherSuites,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if s.tlsOptions.ClientCAFile != "" {
+		data, err := os.ReadFile(s.tlsOptions.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", s.tlsOptions.ClientCAFile)
+		}
+
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.tlsOptions.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TRACER_NAME names the tracer of the HTTP server spans.
+	TRACER_NAME = "github.com/nilspolek/simple-reg/internal/server"
+)
+
+type TracingOptions struct {
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g.
+	// "http://localhost:4318". When empty the OTEL_EXPORTER_OTLP_* variables
+	// apply.
+	Endpoint    string
+	ServiceName string
+	// SampleRatio is the share of traces started here that are recorded,
+	// callers' sampling decisions are always honored.
+	SampleRatio float64
+}
+
+// WithTracing exports spans to an OTLP collector, continues traces of callers
+// sending W3C trace context headers and starts a span for every request.
+// The exporter is flushed on shutdown.
+func (s *Server) WithTracing(options TracingOptions) (*Server, error) {
+	var exporterOptions []otlptracehttp.Option
+	if options.Endpoint != "" {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithEndpointURL(options.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), exporterOptions...)
+	if err != nil {
+		return s, err
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(options.ServiceName)),
+	)
+	if err != nil {
+		return s, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		s.log.Error().Err(err).Msg("tracing")
+	}))
+
+	s.WithMiddleware(tracingMiddleware)
+	s.WithShutdownHook(provider.Shutdown)
+	return s, nil
+}
+
+func tracingMiddleware(next http.Handler) http.Handler {
+	tracer := otel.Tracer(TRACER_NAME)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("request.id", RequestID(r)),
+			),
+		)
+		defer span.End()
+
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rw.statusCode))
+		if rw.statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rw.statusCode))
+		}
+	})
+}
+
+// EndSpan ends span, marking it failed when err is set.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,7 +3,6 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 )
 
@@ -14,6 +13,8 @@ func (s *Server) WithHandlerFunc(path string, handler http.HandlerFunc, methods
 
 type OciErrors struct {
 	Errors []OciError `json:"errors"`
+	// RequestID lets users quote the request when reporting a failure.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type OciError struct {
@@ -26,6 +27,12 @@ func (e OciError) Error() string {
 	return e.Message
 }
 
+// WithDetails returns e explaining the failure with details.
+func (e OciError) WithDetails(details string) OciError {
+	e.Details = details
+	return e
+}
+
 var (
 	ERROR_BLOB_UNKNOWN = OciError{
 		Code:    "code-1",
@@ -87,6 +94,24 @@ var (
 		Message: "DENIED",
 		Details: "requested access to the resource is denied",
 	}
+	// ERROR_QUOTA_EXCEEDED is a DENIED error telling the client why.
+	ERROR_QUOTA_EXCEEDED = OciError{
+		Code:    "code-12",
+		Message: "DENIED",
+		Details: "storage quota exceeded",
+	}
+	// ERROR_MANIFEST_TOO_LARGE and ERROR_BLOB_TOO_LARGE are sent with 413
+	// Request Entity Too Large.
+	ERROR_MANIFEST_TOO_LARGE = OciError{
+		Code:    "code-6",
+		Message: "MANIFEST_INVALID",
+		Details: "manifest exceeds the maximum size",
+	}
+	ERROR_BLOB_TOO_LARGE = OciError{
+		Code:    "code-10",
+		Message: "SIZE_INVALID",
+		Details: "blob exceeds the maximum size",
+	}
 	ERROR_UNSUPPORTED = OciError{
 		Code:    "code-13",
 		Message: "UNSUPPORTED",
@@ -97,24 +122,90 @@ var (
 		Message: "TOOMANYREQUESTS",
 		Details: "too many requests",
 	}
+	ERROR_TAG_INVALID = OciError{
+		Code:    "code-15",
+		Message: "TAG_INVALID",
+		Details: "manifest tag did not match URI",
+	}
+	// ERROR_UNKNOWN is sent with 500 Internal Server Error when the registry
+	// itself fails, the cause is only logged.
+	ERROR_UNKNOWN = OciError{
+		Code:    "code-16",
+		Message: "UNKNOWN",
+		Details: "unknown error",
+	}
+	// ERROR_BAD_REQUEST rejects invalid requests to the registry's own APIs,
+	// which the distribution spec has no code for.
+	ERROR_BAD_REQUEST = OciError{
+		Code:    "code-17",
+		Message: "BAD_REQUEST",
+		Details: "invalid request",
+	}
 )
 
-func WriteErrors(w http.ResponseWriter, errors ...OciError) error {
+func WriteErrors(w http.ResponseWriter, r *http.Request, errors ...OciError) error {
+	return WriteErrorsStatus(w, r, StatusCode(errors[0]), errors...)
+}
+
+// WriteErrorsStatus writes errors with status instead of the one the spec
+// assigns to the first error.
+func WriteErrorsStatus(w http.ResponseWriter, r *http.Request, status int, errors ...OciError) error {
 	errs := OciErrors{
-		Errors: errors,
+		Errors:    errors,
+		RequestID: RequestID(r),
 	}
-	// TODO: Write the appropriate status code
-	w.WriteHeader(400)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	Logger(r).Debug().
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Str("code", errors[0].Message).
+		Msg("request failed")
+
+	return json.NewEncoder(w).Encode(errs)
+}
 
-	log.Println(errors[0].Message)
+// WriteInternalError logs err and answers r with ERROR_UNKNOWN. The request
+// ID of the response finds the log entry.
+func WriteInternalError(w http.ResponseWriter, r *http.Request, err error) error {
+	Logger(r).Error().Err(err).
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Msg("request failed")
+	return WriteErrors(w, r, ERROR_UNKNOWN)
+}
 
-	err := json.NewEncoder(w).Encode(errs)
-	w.Header().Set("application/json", "application/json")
-	return err
+// StatusCode returns the HTTP status the distribution spec assigns to e.
+func StatusCode(e OciError) int {
+	switch e.Message {
+	case ERROR_BLOB_UNKNOWN.Message,
+		ERROR_BLOB_UPLOAD_UNKNOWN.Message,
+		ERROR_MANIFEST_UNKNOWN.Message,
+		ERROR_NAME_UNKNOWN.Message:
+		return http.StatusNotFound
+	case ERROR_UNAUTHORIZED.Message:
+		return http.StatusUnauthorized
+	case ERROR_DENIED.Message:
+		return http.StatusForbidden
+	case ERROR_UNSUPPORTED.Message:
+		return http.StatusMethodNotAllowed
+	case ERROR_TOOMANYREQUESTS.Message:
+		return http.StatusTooManyRequests
+	case ERROR_UNKNOWN.Message:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
 }
 
-func Error(w http.ResponseWriter, message string, code int) {
-	log.Println(message)
+func Error(w http.ResponseWriter, r *http.Request, message string, code int) {
+	event := Logger(r).Debug()
+	if code >= 500 {
+		event = Logger(r).Error()
+	}
+	event.Int("status code", code).Msg(message)
+
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(OciError{
 		Code:    fmt.Sprintf("code-%d", code),
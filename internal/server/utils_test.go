@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestErrorsCarryRequestID(t *testing.T) {
+	svr := NewServer().WithRouter(mux.NewRouter())
+	svr.WithHandlerFunc("/internal", func(w http.ResponseWriter, r *http.Request) {
+		WriteInternalError(w, r, errors.New("disk on fire"))
+	}, http.MethodGet)
+	svr.WithHandlerFunc("/unknown", func(w http.ResponseWriter, r *http.Request) {
+		WriteErrors(w, r, ERROR_BLOB_UNKNOWN)
+	}, http.MethodGet)
+	svr.WithHandlerFunc("/conflict", func(w http.ResponseWriter, r *http.Request) {
+		WriteErrorsStatus(w, r, http.StatusConflict, ERROR_BAD_REQUEST.WithDetails("already exists"))
+	}, http.MethodGet)
+
+	tests := []struct {
+		path    string
+		status  int
+		message string
+		details string
+	}{
+		{"/internal", http.StatusInternalServerError, "UNKNOWN", "unknown error"},
+		{"/unknown", http.StatusNotFound, "BLOB_UNKNOWN", ERROR_BLOB_UNKNOWN.Details},
+		{"/conflict", http.StatusConflict, "BAD_REQUEST", "already exists"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Header.Set(REQUEST_ID_HEADER, "req-1")
+		w := httptest.NewRecorder()
+		svr.Router.ServeHTTP(w, svr.withRequestContext(w, r))
+
+		var body OciErrors
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if w.Code != test.status || len(body.Errors) != 1 || body.Errors[0].Message != test.message || body.Errors[0].Details != test.details {
+			t.Errorf("%s answered %d %+v, want %d %s: %s", test.path, w.Code, body.Errors, test.status, test.message, test.details)
+		}
+		if body.RequestID != "req-1" {
+			t.Errorf("%s answered request ID %q, want req-1", test.path, body.RequestID)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	MAX_NAME_LENGTH = 255
+)
+
+var (
+	// nameRegexp follows the repository name grammar of the OCI distribution spec.
+	nameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*$`)
+	// tagRegexp follows the tag grammar of the OCI distribution spec.
+	tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	// digestRegexp only accepts sha256, the only algorithm the storage supports.
+	digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+func IsValidName(name string) bool {
+	return len(name) <= MAX_NAME_LENGTH && nameRegexp.MatchString(name)
+}
+
+func IsValidTag(tag string) bool {
+	return tagRegexp.MatchString(tag)
+}
+
+func IsValidDigest(digest string) bool {
+	return digestRegexp.MatchString(digest)
+}
+
+// IsValidReference reports whether ref is either a valid tag or a valid digest.
+func IsValidReference(ref string) bool {
+	return IsValidTag(ref) || IsValidDigest(ref)
+}
+
+// IsWithinDir reports whether path, once cleaned and with symlinks
+// resolved, is located inside dir. Parts of path that do not exist yet are
+// compared as they are.
+func IsWithinDir(dir, path string) bool {
+	if !isLexicallyWithin(dir, path) {
+		return false
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		// nothing below a missing dir can be a symlink
+		return true
+	}
+	realPath, err := resolveExisting(path)
+	if err != nil {
+		return false
+	}
+	return isLexicallyWithin(realDir, realPath)
+}
+
+func isLexicallyWithin(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// resolveExisting resolves the symlinks of the longest existing prefix of
+// path and appends the rest.
+func resolveExisting(path string) (string, error) {
+	path = filepath.Clean(path)
+	rest := ""
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// ValidateRepositoryGlob checks that pattern is a glob MatchRepository
+// understands.
+func ValidateRepositoryGlob(pattern string) error {
+	if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+		return fmt.Errorf("invalid repository glob %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// MatchRepository reports whether repo matches pattern, a path.Match glob
+// where a trailing "/**" matches a namespace at any depth and "**" matches
+// every repository.
+func MatchRepository(pattern, repo string) bool {
+	if pattern == "**" {
+		return true
+	}
+	if namespace, ok := strings.CutSuffix(pattern, "/**"); ok {
+		for prefix := repo; prefix != "."; prefix = path.Dir(prefix) {
+			if ok, _ := path.Match(namespace, prefix); ok && prefix != repo {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(pattern, repo)
+	return ok
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsValidName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"alpine", true},
+		{"library/alpine", true},
+		{"team-a/app.v2/web__api", true},
+		{"", false},
+		{"..", false},
+		{"../etc", false},
+		{"library/../../etc", false},
+		{"%2e%2e", false},
+		{"%2e%2e/%2e%2e/etc", false},
+		{"/etc/passwd", false},
+		{"library/", false},
+		{"library//alpine", false},
+		{`..\windows`, false},
+		{"Alpine", false},
+		{"a/./b", false},
+		{strings.Repeat("a", MAX_NAME_LENGTH), true},
+		{strings.Repeat("a", MAX_NAME_LENGTH+1), false},
+	}
+	for _, test := range tests {
+		if got := IsValidName(test.name); got != test.valid {
+			t.Errorf("IsValidName(%q) = %v, want %v", test.name, got, test.valid)
+		}
+	}
+}
+
+func TestIsValidReference(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	tests := []struct {
+		ref        string
+		tag        bool
+		digest     bool
+		validAsRef bool
+	}{
+		{"latest", true, false, true},
+		{"v1.2.3", true, false, true},
+		{hex, true, false, true},
+		{"sha256:" + hex, false, true, true},
+		{"sha256:" + strings.ToUpper(hex), false, false, false},
+		{"sha256:" + hex[:63], false, false, false},
+		{"sha512:" + hex, false, false, false},
+		{"..", false, false, false},
+		{".hidden", false, false, false},
+		{"%2e%2e", false, false, false},
+		{"../latest", false, false, false},
+		{"/latest", false, false, false},
+		{strings.Repeat("a", 128), true, false, true},
+		{strings.Repeat("a", 129), false, false, false},
+	}
+	for _, test := range tests {
+		if got := IsValidTag(test.ref); got != test.tag {
+			t.Errorf("IsValidTag(%q) = %v, want %v", test.ref, got, test.tag)
+		}
+		if got := IsValidDigest(test.ref); got != test.digest {
+			t.Errorf("IsValidDigest(%q) = %v, want %v", test.ref, got, test.digest)
+		}
+		if got := IsValidReference(test.ref); got != test.validAsRef {
+			t.Errorf("IsValidReference(%q) = %v, want %v", test.ref, got, test.validAsRef)
+		}
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	root := t.TempDir()
+	data := filepath.Join(root, "data")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(data, "library", "alpine"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(data, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(data, "library"), filepath.Join(data, "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		within bool
+	}{
+		{filepath.Join(data, "library", "alpine"), true},
+		{filepath.Join(data, "library", "not-yet-created", "_tags"), true},
+		{filepath.Join(data, "alias", "alpine"), true},
+		{data, true},
+		{filepath.Join(data, ".."), false},
+		{filepath.Join(data, "..", "outside"), false},
+		{data + "/library/../../outside", false},
+		{data + "-sibling", false},
+		{"/etc/passwd", false},
+		{filepath.Join(data, "escape"), false},
+		{filepath.Join(data, "escape", "library", "_tags"), false},
+	}
+	for _, test := range tests {
+		if got := IsWithinDir(data, test.path); got != test.within {
+			t.Errorf("IsWithinDir(%q, %q) = %v, want %v", data, test.path, got, test.within)
+		}
+	}
+}
+
+func FuzzIsValidName(f *testing.F) {
+	for _, seed := range []string{"library/alpine", "..", "a/../b", "%2e%2e", "/etc", "a//b", "a/b/", `a\b`, "a.b-c__d"} {
+		f.Add(seed)
+	}
+
+	base := f.TempDir()
+	f.Fuzz(func(t *testing.T, name string) {
+		if !IsValidName(name) {
+			return
+		}
+		for _, segment := range strings.Split(name, "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				t.Fatalf("valid name %q has segment %q", name, segment)
+			}
+		}
+		if strings.ContainsAny(name, `\%`) || filepath.IsAbs(name) {
+			t.Fatalf("valid name %q contains path syntax", name)
+		}
+		if !IsWithinDir(base, filepath.Join(base, name)) {
+			t.Fatalf("valid name %q escapes %q", name, base)
+		}
+	})
+}
+
+func FuzzIsValidReference(f *testing.F) {
+	for _, seed := range []string{"latest", "..", "sha256:" + strings.Repeat("0", 64), "../x", "a/b", ".x"} {
+		f.Add(seed)
+	}
+
+	base := f.TempDir()
+	f.Fuzz(func(t *testing.T, ref string) {
+		if !IsValidReference(ref) {
+			return
+		}
+		if strings.ContainsAny(ref, `/\`) || ref == "." || ref == ".." {
+			t.Fatalf("valid reference %q contains path syntax", ref)
+		}
+		if !IsWithinDir(base, filepath.Join(base, "_tags", ref)) {
+			t.Fatalf("valid reference %q escapes %q", ref, base)
+		}
+	})
+}
+
+func FuzzIsWithinDir(f *testing.F) {
+	for _, seed := range []string{"a", "..", "../x", "a/../../x", "/etc/passwd", "a/./b", "", "./a"} {
+		f.Add(seed)
+	}
+
+	base := filepath.Join(f.TempDir(), "data")
+	f.Fuzz(func(t *testing.T, path string) {
+		joined := filepath.Join(base, path)
+		if !IsWithinDir(base, joined) {
+			return
+		}
+		rel, err := filepath.Rel(base, joined)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("IsWithinDir accepted %q which resolves to %q", path, joined)
+		}
+	})
+}
+
+func TestMatchRepository(t *testing.T) {
+	tests := []struct {
+		pattern string
+		repo    string
+		match   bool
+	}{
+		{"**", "app", true},
+		{"**", "team/app", true},
+		{"app", "app", true},
+		{"app", "apps", false},
+		{"library/*", "library/nginx", true},
+		{"library/*", "library/team/nginx", false},
+		{"library/*", "library", false},
+		{"team-a/**", "team-a/app", true},
+		{"team-a/**", "team-a/sub/app", true},
+		{"team-a/**", "team-a", false},
+		{"team-a/**", "team-b/app", false},
+		{"team-a/**", "team-ab/app", false},
+		{"*/**", "team/app", true},
+		{"*/**", "app", false},
+		{"[", "[", false},
+	}
+	for _, test := range tests {
+		if match := MatchRepository(test.pattern, test.repo); match != test.match {
+			t.Errorf("MatchRepository(%q, %q) = %t, want %t", test.pattern, test.repo, match, test.match)
+		}
+	}
+}